@@ -98,6 +98,11 @@ static void extent_init(struct extent *e, sector_t lba, sector_t pba, sector_t l
 #define MIN_POOL_PAGES 16
 #define MIN_POOL_IOS 16
 
+/* The waits for reads and writes return no extents after the timeout, so the
+ * daemon can stop serving the device.
+ */
+#define WAIT_TIMEOUT HZ
+
 /************** Extent map management *****************/
 
 enum map_type { MAP_READ = 1, MAP_WRITE = 2 };
@@ -967,7 +972,8 @@ static int ioctl_write_wait(struct disbd *dis, void *arg)
 		return -EFAULT;
 	extents = iw.extents;
 
-	wait_event_interruptible(dis->write_wait, !list_empty(&dis->done_writes));
+	wait_event_interruptible_timeout(dis->write_wait, !list_empty(&dis->done_writes),
+					 WAIT_TIMEOUT);
 
 	INIT_LIST_HEAD(&tmp_writes);
 
@@ -1002,14 +1008,37 @@ static int ioctl_write_wait(struct disbd *dis, void *arg)
 	return 0;
 }
 
+/* read_failed returns true if the bio overlaps an extent which userspace failed
+ * to read.
+ */
+static bool read_failed(struct dis_extent *failed, int n_failed, struct bio *bio)
+{
+	sector_t from = bio->bi_iter.bi_sector;
+	sector_t to = from + bio_sectors(bio);
+	int i;
+
+	for (i = 0; i < n_failed; i++) {
+		if (failed[i].lba < to && failed[i].lba + failed[i].len > from)
+			return true;
+	}
+
+	return false;
+}
+
 /* TODO - I don't like this idea of only resolving the faulted reads, since that may
  * make readahead less effective. we'll see. It makes locking easier, though...
+ *
+ * Extents with pba set to PBA_NONE could not be read by userspace, the bios
+ * waiting for them are failed with an I/O error.
  */
 static int ioctl_resolve(struct disbd *dis, void *arg)
 {
 	struct dm_target *ti = dis->ti;
 	struct ioctl_resolve ir;
+	struct dis_extent *failed = NULL;
 	unsigned long flags;
+	int n_failed = 0;
+	int ret = 0;
 	int i;
 
 	if (copy_from_user(&ir, arg, sizeof(ir)))
@@ -1019,14 +1048,27 @@ static int ioctl_resolve(struct disbd *dis, void *arg)
 
 	for (i = 0; i < ir.n_extents; i++) {
 		struct dis_extent e;
-		if (copy_from_user(&e, &extents[i], sizeof(e)))
-			return -EFAULT;
+		if (copy_from_user(&e, &extents[i], sizeof(e))) {
+			ret = -EFAULT;
+			goto out;
+		}
+		if (e.pba == PBA_NONE) {
+			if (failed == NULL)
+				failed = kmalloc_array(ir.n_extents, sizeof(*failed), GFP_KERNEL);
+			if (failed == NULL) {
+				ret = -ENOMEM;
+				goto out;
+			}
+			failed[n_failed++] = e;
+			continue;
+		}
 		if (e.lba < ti->begin || e.lba + e.len > ti->begin + ti->len || e.len == 0 ||
 		    e.pba + e.len > max_pba) {
 			// || e.len % 8*)
 			DMERR("put: invalid range: %lu %lu (%llu-%llu)", (long)e.lba, (long)e.len,
 			      (u64)ti->begin, (u64)(ti->begin + ti->len));
-			return -EINVAL;
+			ret = -EINVAL;
+			goto out;
 		}
 		//DMINFO("resolve: %llu -> %llu +%d", (u64)e.lba, (u64)e.pba, e.len);
 		dis_update_range(dis, e.lba, e.pba, e.len, MAP_READ);
@@ -1037,6 +1079,11 @@ static int ioctl_resolve(struct disbd *dis, void *arg)
 	struct bio *bio;
 	while ((bio = bio_list_pop(&dis->faulted_reads)) != NULL) {
 		//DMINFO("%llx (%llu %d) -> recycle", (u64)bio, (u64)bio->bi_iter.bi_sector, bio_sectors(bio));
+		if (read_failed(failed, n_failed, bio)) {
+			bio->bi_status = BLK_STS_IOERR;
+			bio_endio(bio);
+			continue;
+		}
 		split_read_io(dis, bio);
 	}
 
@@ -1058,7 +1105,9 @@ static int ioctl_resolve(struct disbd *dis, void *arg)
 		spin_unlock_irqrestore(&dis->rb_r_lock, flags);
 	}
 
-	return 0;
+out:
+	kfree(failed);
+	return ret;
 }
 
 static int ioctl_read_wait(struct disbd *dis, void *arg)
@@ -1073,7 +1122,8 @@ static int ioctl_read_wait(struct disbd *dis, void *arg)
 
 	//DMINFO("read_wait pending %d nfaulted %d", !bio_list_empty(&dis->pending_reads), dis->n_faulted);
 	//DMINFO("read_wait pending %d", !bio_list_empty(&dis->pending_reads));
-	wait_event_interruptible(dis->read_wait, !bio_list_empty(&dis->pending_reads));
+	wait_event_interruptible_timeout(dis->read_wait, !bio_list_empty(&dis->pending_reads),
+					 WAIT_TIMEOUT);
 	//DMINFO("read_wait pending %d", !bio_list_empty(&dis->pending_reads));
 
 	struct bio_list tmp = BIO_EMPTY_LIST;
@@ -4,12 +4,14 @@
 package backend
 
 import (
-	"dis/backend/file"
-	"dis/backend/null"
-	"dis/backend/object"
+	"dis/cache"
 	"dis/extent"
 	"dis/parser"
-	"reflect"
+	"fmt"
+	"github.com/spf13/viper"
+	"sort"
+	"strings"
+	"sync"
 )
 
 const (
@@ -18,37 +20,77 @@ const (
 )
 
 var (
-	enabled  string
-	instance backend
+	factoriesMutex sync.Mutex
+	factories      = make(map[string]Factory)
+)
+
+// Backend persists the data of the block device cached by the kernel.
+// Extents are read from and written to the cache of the volume.
+type Backend interface {
+	Read(*[]extent.Extent) error
+	Write(*[]extent.Extent) error
+	// Close persists all writes and stops the backend.
+	Close() error
+}
+
+// Volume is a block device served by the daemon.
+type Volume struct {
+	Name   string
+	Config *parser.Config
+	Cache  *cache.Cache
+}
 
-	backendMap = map[string]reflect.Type{
-		"file":   reflect.TypeOf(file.FileBackend{}),
-		"null":   reflect.TypeOf(null.NullBackend{}),
-		"object": reflect.TypeOf(object.ObjectBackend{}),
+// Factory creates the backend of the volume from its section of the
+// configuration, e.g. backend.file for the backend registered as file.
+type Factory func(v *viper.Viper, vol *Volume) (Backend, error)
+
+// Register makes the backend available under the name. It is meant to be
+// called from init functions of the packages implementing backends.
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	if factory == nil {
+		panic(fmt.Sprintf("Backend %q registered without a factory", name))
 	}
-)
+	if factories[name] != nil {
+		panic(fmt.Sprintf("Backend %q registered twice", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of all registered backends in ascending order.
+func Names() []string {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-type backend interface {
-	Init()
-	Read(*[]extent.Extent)
-	Write(*[]extent.Extent)
+	return names
 }
 
-func Init() {
-	v := parser.Sub(configSection)
+// New creates the backend enabled in the configuration of the volume.
+func New(vol *Volume) (Backend, error) {
+	v := vol.Config.Sub(configSection)
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("enabled")
-	enabled = v.GetString("enabled")
+	enabled := v.GetString("enabled")
 
-	T := backendMap[enabled]
-	instance = reflect.New(T).Interface().(backend)
-	instance.Init()
-}
+	factoriesMutex.Lock()
+	factory := factories[enabled]
+	factoriesMutex.Unlock()
+	if factory == nil {
+		return nil, fmt.Errorf("unknown backend %q, available backends: %v", enabled, strings.Join(Names(), ", "))
+	}
 
-func Read(e *[]extent.Extent) {
-	instance.Read(e)
-}
+	b, err := factory(vol.Config.Sub(configSection+"."+enabled), vol)
+	if err != nil {
+		return nil, fmt.Errorf("backend %v: %w", enabled, err)
+	}
 
-func Write(e *[]extent.Extent) {
-	instance.Write(e)
+	return b, nil
 }
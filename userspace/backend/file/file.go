@@ -4,44 +4,50 @@
 package file
 
 import (
+	"dis/backend"
 	"dis/cache"
 	"dis/extent"
-	"dis/parser"
+	"errors"
+	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
 	"sync"
 )
 
-const (
-	configSection = "backend.file"
-	envPrefix     = "dis_backend_file"
-)
+const envPrefix = "dis_backend_file"
 
-type FileBackend struct{}
+type FileBackend struct {
+	cache *cache.Cache
+	fd    int
+}
 
-var (
-	file string
-	fd   int
-)
+func init() {
+	backend.Register("file", New)
+}
 
-func (this *FileBackend) Init() {
-	v := parser.Sub(configSection)
+func New(v *viper.Viper, vol *backend.Volume) (backend.Backend, error) {
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("file")
-	file = v.GetString("file")
+	file := v.GetString("file")
 
 	if file == "" {
-		panic("")
+		return nil, errors.New("file is not set")
 	}
 
-	var err error
-	fd, err = unix.Open(file, unix.O_RDWR, 0)
+	fd, err := unix.Open(file, unix.O_RDWR, 0)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
+	return &FileBackend{vol.Cache, fd}, nil
+}
+
+func (this *FileBackend) Close() error {
+	return unix.Close(this.fd)
 }
 
-func (this *FileBackend) Write(extents *[]extent.Extent) {
+func (this *FileBackend) Write(extents *[]extent.Extent) error {
 	bufs := make(map[*extent.Extent]*[]byte)
+	var errs extent.Collector
 
 	var reads sync.WaitGroup
 	reads.Add(len(*extents))
@@ -51,11 +57,14 @@ func (this *FileBackend) Write(extents *[]extent.Extent) {
 		bufs[e] = &buf
 
 		go func() {
-			cache.Read(&buf, e.PBA*512)
+			errs.Add(e, this.cache.Read(&buf, e.PBA*512))
 			reads.Done()
 		}()
 	}
 	reads.Wait()
+	if err := errs.Err(); err != nil {
+		return err
+	}
 
 	var writes sync.WaitGroup
 	writes.Add(len(*extents))
@@ -63,32 +72,36 @@ func (this *FileBackend) Write(extents *[]extent.Extent) {
 		e := &(*extents)[i]
 		buf := bufs[e]
 		go func() {
-			_, err := unix.Pwrite(fd, *buf, e.LBA*512)
-			if err != nil {
-				panic(err)
-			}
+			_, err := unix.Pwrite(this.fd, *buf, e.LBA*512)
+			errs.Add(e, err)
 			writes.Done()
 		}()
 	}
 	writes.Wait()
+
+	return errs.Err()
 }
 
-func (this *FileBackend) Read(extents *[]extent.Extent) {
+func (this *FileBackend) Read(extents *[]extent.Extent) error {
+	var errs extent.Collector
+
 	var reads sync.WaitGroup
 	reads.Add(len(*extents))
 	for i := range *extents {
 		e := &(*extents)[i]
-		cache.Reserve(e)
+		this.cache.Reserve(e)
 
 		go func() {
 			buf := make([]byte, e.Len*512)
-			_, err := unix.Pread(fd, buf, e.LBA*512)
-			if err != nil {
-				panic(err)
+			_, err := unix.Pread(this.fd, buf, e.LBA*512)
+			if err == nil {
+				err = this.cache.Write(&buf, e.PBA*512)
 			}
-			cache.Write(&buf, e.PBA*512)
+			errs.Add(e, err)
 			reads.Done()
 		}()
 	}
 	reads.Wait()
+
+	return errs.Err()
 }
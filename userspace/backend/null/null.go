@@ -4,38 +4,46 @@
 package null
 
 import (
+	"dis/backend"
 	"dis/cache"
 	"dis/extent"
-	"dis/parser"
 	"fmt"
+	"github.com/spf13/viper"
 	"sync"
 )
 
-const (
-	configSection = "backend.null"
-	envPrefix     = "dis_backend_null"
-)
+const envPrefix = "dis_backend_null"
 
-var (
+type NullBackend struct {
+	cache               *cache.Cache
 	skipReadInWritePath bool
 	waitForIoctlRound   bool
-)
+}
 
-type NullBackend struct{}
+func init() {
+	backend.Register("null", New)
+}
 
-func (this *NullBackend) Init() {
-	v := parser.Sub(configSection)
+func New(v *viper.Viper, vol *backend.Volume) (backend.Backend, error) {
 	v.SetEnvPrefix(envPrefix)
 
 	v.BindEnv("skipReadInWritePath")
 	v.BindEnv("waitForIoctlRound")
-	skipReadInWritePath = v.GetBool("skipReadInWritePath")
-	waitForIoctlRound = v.GetBool("waitForIoctlRound")
+
+	return &NullBackend{
+		cache:               vol.Cache,
+		skipReadInWritePath: v.GetBool("skipReadInWritePath"),
+		waitForIoctlRound:   v.GetBool("waitForIoctlRound"),
+	}, nil
+}
+
+func (this *NullBackend) Close() error {
+	return nil
 }
 
-func (this *NullBackend) Write(extents *[]extent.Extent) {
-	if skipReadInWritePath {
-		return
+func (this *NullBackend) Write(extents *[]extent.Extent) error {
+	if this.skipReadInWritePath {
+		return nil
 	}
 
 	var wg sync.WaitGroup
@@ -44,16 +52,19 @@ func (this *NullBackend) Write(extents *[]extent.Extent) {
 		e := &(*extents)[i]
 		go func() {
 			buffer := make([]byte, e.Len*512)
-			cache.Read(&buffer, e.PBA*512)
+			this.cache.Read(&buffer, e.PBA*512)
 			wg.Done()
 		}()
 	}
 
-	if waitForIoctlRound {
+	if this.waitForIoctlRound {
 		wg.Wait()
 	}
+
+	return nil
 }
 
-func (this *NullBackend) Read(extents *[]extent.Extent) {
+func (this *NullBackend) Read(extents *[]extent.Extent) error {
 	fmt.Println("NullBackend.Read()")
+	return nil
 }
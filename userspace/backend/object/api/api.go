@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ObjectStore is a single volume in an object store. Data objects are
+// addressed by their keys, metadata objects, e.g. checkpoints and snapshots,
+// by their names.
+type ObjectStore interface {
+	// Put stores the whole object, an empty buf voids it.
+	Put(key int64, buf []byte) error
+	// GetRange fills buf with the object data starting at the offset from.
+	// A range past the end of the object is an error.
+	GetRange(key int64, buf []byte, from int64) error
+	Delete(key int64) error
+	// List calls fn for all objects with keys greater than after in
+	// ascending order.
+	List(after int64, fn func(key, size int64)) error
+	// Head returns the size of the object.
+	Head(key int64) (int64, error)
+
+	PutMeta(name string, buf []byte) error
+	GetMeta(name string) ([]byte, error)
+	// ListMeta returns names of metadata objects with the prefix in
+	// ascending order.
+	ListMeta(prefix string) ([]string, error)
+	DeleteMeta(name string) error
+
+	// Exists returns true if the bucket, pool or directory exists.
+	Exists() bool
+	// Empty returns true if there are no objects of the volume.
+	Empty() (bool, error)
+	// Create creates the bucket, pool or directory if possible.
+	Create() error
+	// Wipe deletes all objects of the volume.
+	Wipe() error
+}
+
+// Separator ends the prefix of a volume in the names of its objects. Names
+// within a volume never contain it, so a volume does not see the objects of
+// another one whose prefix starts the same, e.g. "a" and "a1".
+const Separator = "/"
+
+const keyFmt = "%08d"
+
+// Prefix returns the start of the names of all objects of the volume with the
+// prefix.
+func Prefix(prefix string) string {
+	if prefix == "" || strings.HasSuffix(prefix, Separator) {
+		return prefix
+	}
+
+	return prefix + Separator
+}
+
+// Name returns the name of the object within the volume whose names start with
+// prefix, as returned by Prefix. It returns false if the object belongs to
+// another volume.
+func Name(prefix, oid string) (string, bool) {
+	if !strings.HasPrefix(oid, prefix) {
+		return "", false
+	}
+	name := oid[len(prefix):]
+
+	return name, name != "" && !strings.Contains(name, Separator)
+}
+
+// KeyName returns the name of the data object with the key.
+func KeyName(key int64) string {
+	return fmt.Sprintf(keyFmt, key)
+}
+
+// Key returns the key of the data object with the name within the volume. It
+// returns false for metadata objects and anything else not named by KeyName.
+func Key(name string) (int64, bool) {
+	key, err := strconv.ParseInt(name, 10, 64)
+
+	return key, err == nil && key >= 0 && KeyName(key) == name
+}
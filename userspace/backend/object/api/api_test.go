@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package api
+
+import (
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	for _, c := range []struct {
+		prefix, oid string
+		name        string
+		ok          bool
+	}{
+		{"", "00000001", "00000001", true},
+		{"", "manifest", "manifest", true},
+		{"", "a/00000001", "", false},
+		{"a", "a/00000001", "00000001", true},
+		{"a", "a/checkpoint-00000001", "checkpoint-00000001", true},
+		{"a", "a1/00000001", "", false},
+		{"a", "a/b/00000001", "", false},
+		{"a", "a/", "", false},
+		{"a", "a00000001", "", false},
+		{"a/", "a/00000001", "00000001", true},
+	} {
+		name, ok := Name(Prefix(c.prefix), c.oid)
+		if ok != c.ok || ok && name != c.name {
+			t.Errorf("prefix %q, object %q: %q %v", c.prefix, c.oid, name, ok)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		key  int64
+		ok   bool
+	}{
+		{"00000000", 0, true},
+		{"00000042", 42, true},
+		{"123456789", 123456789, true},
+		{"0000001", 0, false},
+		{"000000001", 0, false},
+		{"+0000001", 0, false},
+		{"-0000001", 0, false},
+		{"manifest", 0, false},
+		{"checkpoint-00000001", 0, false},
+	} {
+		key, ok := Key(c.name)
+		if ok != c.ok || ok && key != c.key {
+			t.Errorf("%q: %v %v", c.name, key, ok)
+		}
+	}
+}
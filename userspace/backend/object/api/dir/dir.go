@@ -0,0 +1,220 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package dir
+
+import (
+	"dis/backend/object/api"
+	"dis/parser"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	configSection = "backend.object.dir"
+	envPrefix     = "dis_backend_object_dir"
+
+	// Objects are written to temporary files first, listings skip them
+	tmpPrefix = "."
+)
+
+// Store is a volume stored as files in a local directory. A volume with a
+// prefix is stored in the subdirectory of that name, so several volumes can
+// share a directory.
+type Store struct {
+	path string
+}
+
+func Init(cfg *parser.Config) *Store {
+	return Configure(cfg.Sub(configSection), envPrefix)
+}
+
+// Configure creates the store from another section of the configuration,
+// e.g. the one of a mirror.
+func Configure(v *viper.Viper, envPrefix string) *Store {
+	v.SetEnvPrefix(envPrefix)
+	v.BindEnv("path")
+	v.BindEnv("prefix")
+	path := v.GetString("path")
+	prefix := v.GetString("prefix")
+
+	if path == "" {
+		panic("")
+	}
+
+	return Open(path, prefix)
+}
+
+// Open returns another volume stored in the directory.
+func Open(path, prefix string) *Store {
+	return &Store{filepath.Join(path, prefix)}
+}
+
+func (this *Store) name(key int64) string {
+	return api.KeyName(key)
+}
+
+func (this *Store) file(name string) string {
+	return filepath.Join(this.path, name)
+}
+
+// Exists returns true if the directory exists.
+func (this *Store) Exists() bool {
+	info, err := os.Stat(this.path)
+	return err == nil && info.IsDir()
+}
+
+// Empty returns true if there are no files of the volume in the directory.
+func (this *Store) Empty() (bool, error) {
+	var empty = true
+	err := this.walk("", func(name string, size int64) {
+		empty = false
+	})
+
+	return empty, err
+}
+
+// Create creates the directory if it does not exist yet.
+func (this *Store) Create() error {
+	return os.MkdirAll(this.path, 0700)
+}
+
+// Wipe deletes all files of the volume in the directory.
+func (this *Store) Wipe() error {
+	var names []string
+	err := this.walk("", func(name string, size int64) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := os.Remove(this.file(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *Store) Put(key int64, buf []byte) error {
+	return this.write(this.name(key), buf)
+}
+
+// GetRange reads the object starting at the offset from. A range past the end
+// of the object fails with io.ErrUnexpectedEOF.
+func (this *Store) GetRange(key int64, buf []byte, from int64) error {
+	f, err := os.Open(this.file(this.name(key)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.ReadAt(buf, from); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (this *Store) Delete(key int64) error {
+	return os.Remove(this.file(this.name(key)))
+}
+
+func (this *Store) Head(key int64) (int64, error) {
+	info, err := os.Stat(this.file(this.name(key)))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// PutMeta stores a metadata object, e.g. a checkpoint, under the name.
+func (this *Store) PutMeta(name string, buf []byte) error {
+	return this.write(name, buf)
+}
+
+// write replaces the file atomically, so a crash leaves either the old or the
+// new content.
+func (this *Store) write(name string, buf []byte) error {
+	f, err := ioutil.TempFile(this.path, tmpPrefix+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), this.file(name))
+}
+
+// GetMeta returns the whole metadata object stored under the name.
+func (this *Store) GetMeta(name string) ([]byte, error) {
+	return ioutil.ReadFile(this.file(name))
+}
+
+// ListMeta returns names of metadata objects with the prefix in ascending
+// order.
+func (this *Store) ListMeta(prefix string) ([]string, error) {
+	var names []string
+	err := this.walk(prefix, func(name string, size int64) {
+		names = append(names, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+func (this *Store) DeleteMeta(name string) error {
+	return os.Remove(this.file(name))
+}
+
+// List calls fn for all objects with keys greater than after in ascending
+// order. Metadata objects are skipped.
+func (this *Store) List(after int64, fn func(key, size int64)) error {
+	return this.walk("", func(name string, size int64) {
+		key, ok := api.Key(name)
+		if !ok || key <= after {
+			return
+		}
+		fn(key, size)
+	})
+}
+
+// walk calls fn for all regular files with the prefix in ascending order of
+// their names. Subdirectories, e.g. of other volumes, are skipped.
+func (this *Store) walk(prefix string, fn func(name string, size int64)) error {
+	infos, err := ioutil.ReadDir(this.path)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, tmpPrefix) || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		fn(name, info.Size())
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package dir
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestGetRange(t *testing.T) {
+	path, err := ioutil.TempDir("", "dis-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	st := Open(path, "vol")
+	if err := st.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("0123456789")
+	if err := st.Put(1, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if err := st.GetRange(1, buf, 6); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[6:]) {
+		t.Fatalf("read %q", buf)
+	}
+
+	for _, c := range []struct {
+		key, from int64
+	}{{1, 7}, {1, 10}, {1, 20}, {2, 0}} {
+		if err := st.GetRange(c.key, buf, c.from); err != io.ErrUnexpectedEOF {
+			t.Errorf("object %v from %v: %v", c.key, c.from, err)
+		}
+	}
+	if err := st.GetRange(3, buf, 0); !os.IsNotExist(err) {
+		t.Errorf("missing object: %v", err)
+	}
+}
+
+func TestSharedDirectory(t *testing.T) {
+	path, err := ioutil.TempDir("", "dis-dir-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	root, a, a1 := Open(path, ""), Open(path, "a"), Open(path, "a1")
+	for i, st := range []*Store{root, a, a1} {
+		if err := st.Create(); err != nil {
+			t.Fatal(err)
+		}
+		for key := int64(1); key <= int64(i)+1; key++ {
+			if err := st.Put(key, []byte("data")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := st.PutMeta("manifest", []byte("meta")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, st := range []*Store{root, a, a1} {
+		var keys []int64
+		if err := st.List(-1, func(key, size int64) { keys = append(keys, key) }); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != i+1 {
+			t.Errorf("store %v lists keys %v", i, keys)
+		}
+		names, err := st.ListMeta("man")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != "manifest" {
+			t.Errorf("store %v lists metadata %v", i, names)
+		}
+	}
+
+	if err := a.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	for i, st := range []*Store{root, a, a1} {
+		empty, err := st.Empty()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if empty != (st == a) {
+			t.Errorf("store %v empty: %v", i, empty)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package faults
+
+import (
+	"dis/backend/object/api"
+	"dis/parser"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	configSection = "backend.object.faults"
+	envPrefix     = "dis_backend_object_faults"
+)
+
+var (
+	ErrInjected = errors.New("injected fault")
+	ErrMissing  = errors.New("injected fault: object does not exist")
+)
+
+// Faults are the faults injected into the stores of a single volume.
+type Faults struct {
+	latency       string
+	latencyMean   time.Duration
+	errorRate     float64
+	shortReadRate float64
+	stallRate     float64
+	stall         time.Duration
+	missingRate   float64
+
+	rngMutex sync.Mutex
+	rng      *rand.Rand
+}
+
+// Init reads the configuration of the injected faults. It returns nil if
+// they are disabled.
+func Init(cfg *parser.Config) *Faults {
+	v := cfg.Sub(configSection)
+	v.SetEnvPrefix(envPrefix)
+	v.BindEnv("enabled")
+	v.BindEnv("latency")
+	v.BindEnv("latencyMs")
+	v.BindEnv("errorRate")
+	v.BindEnv("shortReadRate")
+	v.BindEnv("stallRate")
+	v.BindEnv("stallMs")
+	v.BindEnv("missingRate")
+	v.BindEnv("seed")
+	if !v.GetBool("enabled") {
+		return nil
+	}
+
+	this := &Faults{
+		latency:       v.GetString("latency"),
+		latencyMean:   time.Duration(v.GetInt64("latencyMs")) * time.Millisecond,
+		errorRate:     v.GetFloat64("errorRate"),
+		shortReadRate: v.GetFloat64("shortReadRate"),
+		stallRate:     v.GetFloat64("stallRate"),
+		stall:         time.Duration(v.GetInt64("stallMs")) * time.Millisecond,
+		missingRate:   v.GetFloat64("missingRate"),
+	}
+	seed := v.GetInt64("seed")
+
+	if this.latency == "" {
+		this.latency = "none"
+	}
+	if this.latency != "none" && this.latency != "fixed" && this.latency != "uniform" && this.latency != "exponential" {
+		panic(fmt.Sprintf("Unknown latency distribution %q", this.latency))
+	}
+	for name, rate := range map[string]float64{
+		"errorRate":     this.errorRate,
+		"shortReadRate": this.shortReadRate,
+		"stallRate":     this.stallRate,
+		"missingRate":   this.missingRate,
+	} {
+		if rate < 0 || rate > 1 {
+			panic(fmt.Sprintf("Fault probability %v = %v is not between 0 and 1", name, rate))
+		}
+	}
+	if this.latencyMean < 0 || this.stall < 0 {
+		panic("Fault latencyMs and stallMs cannot be negative")
+	}
+
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	this.rng = rand.New(rand.NewSource(seed))
+	fmt.Println("Injecting object store faults, seed", seed)
+
+	return this
+}
+
+// Wrap returns the store with the configured faults injected into its
+// requests. Checks of the store done at the startup are passed through.
+func (this *Faults) Wrap(st api.ObjectStore) api.ObjectStore {
+	return &faulty{st, this}
+}
+
+type faulty struct {
+	api.ObjectStore
+	faults *Faults
+}
+
+func (this *Faults) chance(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	this.rngMutex.Lock()
+	defer this.rngMutex.Unlock()
+
+	return this.rng.Float64() < rate
+}
+
+func (this *Faults) delay() time.Duration {
+	this.rngMutex.Lock()
+	defer this.rngMutex.Unlock()
+
+	switch this.latency {
+	case "fixed":
+		return this.latencyMean
+	case "uniform":
+		return time.Duration(this.rng.Int63n(int64(2*this.latencyMean) + 1))
+	case "exponential":
+		return time.Duration(this.rng.ExpFloat64() * float64(this.latencyMean))
+	}
+
+	return 0
+}
+
+// request delays the request and decides whether it fails.
+func (this *Faults) request() error {
+	time.Sleep(this.delay())
+	if this.chance(this.stallRate) {
+		time.Sleep(this.stall)
+	}
+	if this.chance(this.errorRate) {
+		return ErrInjected
+	}
+
+	return nil
+}
+
+func (this *faulty) Put(key int64, buf []byte) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	return this.ObjectStore.Put(key, buf)
+}
+
+// GetRange may also fail as if the object did not exist, or return only a
+// part of the range with the rest zeroed and no error.
+func (this *faulty) GetRange(key int64, buf []byte, from int64) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	if this.faults.chance(this.faults.missingRate) {
+		return ErrMissing
+	}
+	if err := this.ObjectStore.GetRange(key, buf, from); err != nil {
+		return err
+	}
+
+	if len(buf) > 1 && this.faults.chance(this.faults.shortReadRate) {
+		this.faults.rngMutex.Lock()
+		n := 1 + this.faults.rng.Intn(len(buf)-1)
+		this.faults.rngMutex.Unlock()
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+	}
+
+	return nil
+}
+
+func (this *faulty) Delete(key int64) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	return this.ObjectStore.Delete(key)
+}
+
+func (this *faulty) Head(key int64) (int64, error) {
+	if err := this.faults.request(); err != nil {
+		return 0, err
+	}
+	if this.faults.chance(this.faults.missingRate) {
+		return 0, ErrMissing
+	}
+	return this.ObjectStore.Head(key)
+}
+
+func (this *faulty) PutMeta(name string, buf []byte) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	return this.ObjectStore.PutMeta(name, buf)
+}
+
+func (this *faulty) GetMeta(name string) ([]byte, error) {
+	if err := this.faults.request(); err != nil {
+		return nil, err
+	}
+	if this.faults.chance(this.faults.missingRate) {
+		return nil, ErrMissing
+	}
+	return this.ObjectStore.GetMeta(name)
+}
+
+func (this *faulty) ListMeta(prefix string) ([]string, error) {
+	if err := this.faults.request(); err != nil {
+		return nil, err
+	}
+	return this.ObjectStore.ListMeta(prefix)
+}
+
+func (this *faulty) DeleteMeta(name string) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	return this.ObjectStore.DeleteMeta(name)
+}
+
+func (this *faulty) List(after int64, fn func(key, size int64)) error {
+	if err := this.faults.request(); err != nil {
+		return err
+	}
+	return this.ObjectStore.List(after, fn)
+}
@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package faults
+
+import (
+	"dis/parser"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func load(t *testing.T, section string) *parser.Config {
+	dir, err := ioutil.TempDir("", "dis-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(name, []byte("[backend.object.faults]\n"+section), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parser.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cfg
+}
+
+func TestInit(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		enabled bool
+		invalid bool
+	}{
+		{"disabled", "latency = \"fixed\"\n", false, false},
+		{"disabled with stale values", "latency = \"gamma\"\nerrorRate = 2\nstallMs = -1\n", false, false},
+		{"enabled", "enabled = true\nlatency = \"uniform\"\nlatencyMs = 5\nerrorRate = 0.1\n", true, false},
+		{"unknown latency", "enabled = true\nlatency = \"gamma\"\n", true, true},
+		{"probability above 1", "enabled = true\nmissingRate = 1.5\n", true, true},
+		{"negative probability", "enabled = true\nshortReadRate = -0.1\n", true, true},
+		{"negative stall", "enabled = true\nstallMs = -1\n", true, true},
+	}
+
+	for _, test := range tests {
+		cfg := load(t, test.section)
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != test.invalid {
+					t.Errorf("%v: panic %v", test.name, r)
+				}
+			}()
+			if f := Init(cfg); (f != nil) != test.enabled {
+				t.Errorf("%v: faults %v", test.name, f)
+			}
+		}()
+	}
+}
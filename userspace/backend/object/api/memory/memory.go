@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package memory
+
+import (
+	"dis/parser"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	configSection = "backend.object.memory"
+	envPrefix     = "dis_backend_object_memory"
+)
+
+var (
+	ErrFull    = errors.New("memory store is full")
+	ErrMissing = errors.New("object does not exist")
+)
+
+// Store keeps objects in memory, so they are lost when the daemon exits. It
+// is meant for tests and benchmarks of the object pipeline.
+type Store struct {
+	mutex    sync.RWMutex
+	objects  map[string][]byte
+	size     int64
+	capacity int64
+}
+
+func Init(cfg *parser.Config) *Store {
+	return Configure(cfg.Sub(configSection), envPrefix)
+}
+
+// Configure creates the store from another section of the configuration,
+// e.g. the one of a mirror.
+func Configure(v *viper.Viper, envPrefix string) *Store {
+	v.SetEnvPrefix(envPrefix)
+	v.BindEnv("capacityM")
+
+	return New(v.GetInt64("capacityM") * 1024 * 1024)
+}
+
+// New returns an empty store holding at most capacity bytes, zero means
+// unlimited.
+func New(capacity int64) *Store {
+	return &Store{objects: make(map[string][]byte), capacity: capacity}
+}
+
+const keyFmt = "%08d"
+
+func name(key int64) string {
+	return fmt.Sprintf(keyFmt, key)
+}
+
+// Exists returns true, the store exists as long as the daemon runs.
+func (this *Store) Exists() bool {
+	return true
+}
+
+func (this *Store) Empty() (bool, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	return len(this.objects) == 0, nil
+}
+
+func (this *Store) Create() error {
+	return nil
+}
+
+func (this *Store) Wipe() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.objects = make(map[string][]byte)
+	this.size = 0
+
+	return nil
+}
+
+func (this *Store) Put(key int64, buf []byte) error {
+	return this.put(name(key), buf)
+}
+
+// GetRange reads the object starting at the offset from. A range past the end
+// of the object fails with io.ErrUnexpectedEOF.
+func (this *Store) GetRange(key int64, buf []byte, from int64) error {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	obj, ok := this.objects[name(key)]
+	if !ok {
+		return ErrMissing
+	}
+	if from < 0 || from+int64(len(buf)) > int64(len(obj)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(buf, obj[from:])
+
+	return nil
+}
+
+func (this *Store) Delete(key int64) error {
+	return this.remove(name(key))
+}
+
+func (this *Store) Head(key int64) (int64, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	obj, ok := this.objects[name(key)]
+	if !ok {
+		return 0, ErrMissing
+	}
+
+	return int64(len(obj)), nil
+}
+
+// PutMeta stores a metadata object, e.g. a checkpoint, under the name.
+func (this *Store) PutMeta(name string, buf []byte) error {
+	return this.put(name, buf)
+}
+
+func (this *Store) put(name string, buf []byte) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	size := this.size - int64(len(this.objects[name])) + int64(len(buf))
+	if this.capacity != 0 && size > this.capacity {
+		return ErrFull
+	}
+
+	this.objects[name] = append([]byte{}, buf...)
+	this.size = size
+
+	return nil
+}
+
+// GetMeta returns the whole metadata object stored under the name.
+func (this *Store) GetMeta(name string) ([]byte, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	obj, ok := this.objects[name]
+	if !ok {
+		return nil, fmt.Errorf("%v: %w", name, ErrMissing)
+	}
+
+	return append([]byte{}, obj...), nil
+}
+
+// ListMeta returns names of metadata objects with the prefix in ascending
+// order.
+func (this *Store) ListMeta(prefix string) ([]string, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	var names []string
+	for name := range this.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (this *Store) DeleteMeta(name string) error {
+	return this.remove(name)
+}
+
+func (this *Store) remove(name string) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	obj, ok := this.objects[name]
+	if !ok {
+		return fmt.Errorf("%v: %w", name, ErrMissing)
+	}
+	this.size -= int64(len(obj))
+	delete(this.objects, name)
+
+	return nil
+}
+
+// List calls fn for all objects with keys greater than after in ascending
+// order. Metadata objects are skipped.
+func (this *Store) List(after int64, fn func(key, size int64)) error {
+	type object struct {
+		key, size int64
+	}
+
+	this.mutex.RLock()
+	var objects []object
+	for name, obj := range this.objects {
+		key, err := strconv.ParseInt(name, 10, 64)
+		if err != nil || key <= after {
+			continue
+		}
+		objects = append(objects, object{key, int64(len(obj))})
+	}
+	this.mutex.RUnlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].key < objects[j].key })
+	for _, o := range objects {
+		fn(o.key, o.size)
+	}
+
+	return nil
+}
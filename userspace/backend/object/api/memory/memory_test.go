@@ -0,0 +1,95 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestObjects(t *testing.T) {
+	st := New(0)
+
+	data := []byte("0123456789")
+	if err := st.Put(2, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PutMeta("checkpoint-00000003", []byte("cp")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	if err := st.GetRange(2, buf, 6); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[6:]) {
+		t.Fatalf("read %q", buf)
+	}
+	for _, c := range []struct {
+		key, from int64
+	}{{2, 7}, {2, 20}, {1, 0}} {
+		if err := st.GetRange(c.key, buf, c.from); err != io.ErrUnexpectedEOF {
+			t.Errorf("object %v from %v: %v", c.key, c.from, err)
+		}
+	}
+	if err := st.GetRange(3, buf, 0); !errors.Is(err, ErrMissing) {
+		t.Errorf("missing object: %v", err)
+	}
+
+	var keys, sizes []int64
+	err := st.List(0, func(key, size int64) {
+		keys = append(keys, key)
+		sizes = append(sizes, size)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []int64{1, 2}) || !reflect.DeepEqual(sizes, []int64{0, 10}) {
+		t.Fatalf("listed %v of sizes %v", keys, sizes)
+	}
+
+	if err := st.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Head(2); !errors.Is(err, ErrMissing) {
+		t.Fatalf("deleted object: %v", err)
+	}
+	names, err := st.ListMeta("checkpoint-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"checkpoint-00000003"}) {
+		t.Fatalf("listed metadata %v", names)
+	}
+}
+
+func TestCapacity(t *testing.T) {
+	st := New(10)
+
+	if err := st.Put(0, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PutMeta("manifest", make([]byte, 4)); err != ErrFull {
+		t.Fatalf("store over its capacity: %v", err)
+	}
+	// Replaced objects free their space
+	if err := st.Put(0, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PutMeta("manifest", make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.DeleteMeta("manifest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Put(1, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package mirror
+
+import (
+	"dis/backend/object/api"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Store keeps every object in two stores. Writes succeed only if both stores
+// accept them, reads are served by the primary store and fall back to the
+// secondary one if the primary fails.
+type Store struct {
+	primary   api.ObjectStore
+	secondary api.ObjectStore
+}
+
+func New(primary, secondary api.ObjectStore) *Store {
+	return &Store{primary, secondary}
+}
+
+// Secondary returns the secondary store. Data failing the verification are
+// read from it again.
+func (this *Store) Secondary() api.ObjectStore {
+	return this.secondary
+}
+
+// both runs fn on both stores concurrently.
+func (this *Store) both(fn func(st api.ObjectStore) error) error {
+	var perr, serr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		perr = fn(this.primary)
+		wg.Done()
+	}()
+	go func() {
+		serr = fn(this.secondary)
+		wg.Done()
+	}()
+	wg.Wait()
+
+	switch {
+	case perr != nil && serr != nil:
+		return fmt.Errorf("primary: %v, secondary: %w", perr, serr)
+	case perr != nil:
+		return fmt.Errorf("primary: %w", perr)
+	case serr != nil:
+		return fmt.Errorf("secondary: %w", serr)
+	}
+
+	return nil
+}
+
+// fallback runs fn on the primary store and then on the secondary one if it
+// failed.
+func (this *Store) fallback(what string, fn func(st api.ObjectStore) error) error {
+	perr := fn(this.primary)
+	if perr == nil {
+		return nil
+	}
+	if serr := fn(this.secondary); serr != nil {
+		return fmt.Errorf("primary: %v, secondary: %w", perr, serr)
+	}
+	fmt.Println(what, "read from the secondary store, primary failed:", perr)
+
+	return nil
+}
+
+func (this *Store) Put(key int64, buf []byte) error {
+	return this.both(func(st api.ObjectStore) error {
+		return st.Put(key, buf)
+	})
+}
+
+func (this *Store) GetRange(key int64, buf []byte, from int64) error {
+	return this.fallback(fmt.Sprint("Object ", key), func(st api.ObjectStore) error {
+		return st.GetRange(key, buf, from)
+	})
+}
+
+func (this *Store) Delete(key int64) error {
+	return this.both(func(st api.ObjectStore) error {
+		return st.Delete(key)
+	})
+}
+
+// List continues listing the secondary store after the last key listed by
+// the primary one, so fn never gets a key twice.
+func (this *Store) List(after int64, fn func(key, size int64)) error {
+	last := after
+	return this.fallback("Object list", func(st api.ObjectStore) error {
+		return st.List(last, func(key, size int64) {
+			last = key
+			fn(key, size)
+		})
+	})
+}
+
+func (this *Store) Head(key int64) (int64, error) {
+	var size int64
+	err := this.fallback(fmt.Sprint("Object ", key), func(st api.ObjectStore) error {
+		var err error
+		size, err = st.Head(key)
+		return err
+	})
+
+	return size, err
+}
+
+func (this *Store) PutMeta(name string, buf []byte) error {
+	return this.both(func(st api.ObjectStore) error {
+		return st.PutMeta(name, buf)
+	})
+}
+
+func (this *Store) GetMeta(name string) ([]byte, error) {
+	var buf []byte
+	err := this.fallback("Metadata "+name, func(st api.ObjectStore) error {
+		var err error
+		buf, err = st.GetMeta(name)
+		return err
+	})
+
+	return buf, err
+}
+
+func (this *Store) ListMeta(prefix string) ([]string, error) {
+	var names []string
+	err := this.fallback("Metadata list", func(st api.ObjectStore) error {
+		var err error
+		names, err = st.ListMeta(prefix)
+		return err
+	})
+
+	return names, err
+}
+
+func (this *Store) DeleteMeta(name string) error {
+	return this.both(func(st api.ObjectStore) error {
+		return st.DeleteMeta(name)
+	})
+}
+
+// Exists returns true if any of the stores exists, so a volume present only
+// in one of them is not overwritten by a new one.
+func (this *Store) Exists() bool {
+	return this.primary.Exists() || this.secondary.Exists()
+}
+
+// Empty fails if only one of the stores holds the volume. Such a volume has
+// to be copied to the other store before it is mirrored.
+func (this *Store) Empty() (bool, error) {
+	empty := func(st api.ObjectStore) (bool, error) {
+		if !st.Exists() {
+			return true, nil
+		}
+		return st.Empty()
+	}
+
+	p, err := empty(this.primary)
+	if err != nil {
+		return false, fmt.Errorf("primary: %w", err)
+	}
+	s, err := empty(this.secondary)
+	if err != nil {
+		return false, fmt.Errorf("secondary: %w", err)
+	}
+	if p != s {
+		return false, errors.New("only one of the mirrored stores holds the volume")
+	}
+
+	return p, nil
+}
+
+func (this *Store) Create() error {
+	return this.both(func(st api.ObjectStore) error {
+		return st.Create()
+	})
+}
+
+func (this *Store) Wipe() error {
+	return this.both(func(st api.ObjectStore) error {
+		if !st.Exists() {
+			return nil
+		}
+		return st.Wipe()
+	})
+}
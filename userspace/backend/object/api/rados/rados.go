@@ -4,9 +4,14 @@
 package rados
 
 import (
+	"dis/backend/object/api"
 	"dis/parser"
 	"fmt"
 	"github.com/ceph/go-ceph/rados"
+	"github.com/spf13/viper"
+	"io"
+	"sort"
+	"strings"
 )
 
 const (
@@ -14,23 +19,33 @@ const (
 	envPrefix     = "dis_backend_object_rados"
 )
 
-var (
-	conn *rados.Conn
-	pool string
-)
+// Store is a volume stored in a pool. All object names of the volume start
+// with the prefix followed by the separator, so several volumes can share a
+// single pool.
+type Store struct {
+	conn   *rados.Conn
+	pool   string
+	prefix string
+}
 
-func Init() {
-	v := parser.Sub(configSection)
+func Init(cfg *parser.Config) *Store {
+	return Configure(cfg.Sub(configSection), envPrefix)
+}
+
+// Configure creates the store from another section of the configuration,
+// e.g. the one of a mirror.
+func Configure(v *viper.Viper, envPrefix string) *Store {
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("pool")
-	pool = v.GetString("pool")
+	v.BindEnv("prefix")
+	pool := v.GetString("pool")
+	prefix := v.GetString("prefix")
 
 	if pool == "" {
 		panic("")
 	}
 
-	var err error
-	conn, err = rados.NewConn()
+	conn, err := rados.NewConn()
 	if err != nil {
 		panic(err)
 	}
@@ -45,45 +60,230 @@ func Init() {
 		panic(err)
 	}
 
-	ioctx, err := conn.OpenIOContext(pool)
+	return &Store{conn, pool, api.Prefix(prefix)}
+}
+
+// Open returns another volume accessible through the same connection.
+func (this *Store) Open(pool, prefix string) *Store {
+	return &Store{this.conn, pool, api.Prefix(prefix)}
+}
+
+// Exists returns true if the pool exists. Pools are managed outside of DIS, so
+// this is expected to hold.
+func (this *Store) Exists() bool {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
 	if err != nil {
-		panic(err)
+		return false
+	}
+	ioctx.Destroy()
+
+	return true
+}
+
+// Empty returns true if there are no objects of the volume in the pool.
+func (this *Store) Empty() (bool, error) {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return false, err
 	}
+	defer ioctx.Destroy()
 
-	ioctx.ListObjects(func(oid string) { ioctx.Delete(oid) })
+	var empty = true
+	err = ioctx.ListObjects(func(oid string) {
+		if _, ok := api.Name(this.prefix, oid); ok {
+			empty = false
+		}
+	})
 
-	go func() { ioctx.Destroy() }()
+	return empty, err
 }
 
-const keyFmt = "%08d"
+// Create does nothing as the pool has to be created by the administrator.
+func (this *Store) Create() error {
+	if !this.Exists() {
+		return fmt.Errorf("Pool %v does not exist", this.pool)
+	}
+
+	return nil
+}
 
-func Upload(key int64, buf *[]byte) {
-	ioctx, err := conn.OpenIOContext(pool)
+// Wipe deletes all objects of the volume in the pool.
+func (this *Store) Wipe() error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer ioctx.Destroy()
+
+	return ioctx.ListObjects(func(oid string) {
+		if _, ok := api.Name(this.prefix, oid); ok {
+			ioctx.Delete(oid)
+		}
+	})
+}
 
-	err = ioctx.Write(fmt.Sprintf(keyFmt, key), *buf, 0)
+func (this *Store) name(key int64) string {
+	return this.prefix + api.KeyName(key)
+}
+
+// Put replaces the whole object, so no tail of an older object with the same
+// key is left behind.
+func (this *Store) Put(key int64, buf []byte) error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer func() { go ioctx.Destroy() }()
 
-	go func() { ioctx.Destroy() }()
+	return ioctx.WriteFull(this.name(key), buf)
 }
 
-func Download(key int64, buf *[]byte, from, to int64) {
-	if to-from+1 != int64(len(*buf)) {
-		panic("")
+func (this *Store) GetRange(key int64, buf []byte, from int64) error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return err
 	}
-	ioctx, err := conn.OpenIOContext(pool)
+	defer func() { go ioctx.Destroy() }()
+
+	n, err := ioctx.Read(this.name(key), buf, uint64(from))
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if n != len(buf) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+func (this *Store) Delete(key int64) error {
+	return this.remove(this.name(key))
+}
+
+func (this *Store) Head(key int64) (int64, error) {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return 0, err
 	}
+	defer ioctx.Destroy()
 
-	_, err = ioctx.Read(fmt.Sprintf(keyFmt, key), *buf, uint64(from))
+	stat, err := ioctx.Stat(this.name(key))
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+
+	return int64(stat.Size), nil
+}
+
+// PutMeta stores a metadata object, e.g. a checkpoint, under the name.
+func (this *Store) PutMeta(name string, buf []byte) error {
+	return this.write(this.prefix+name, buf)
+}
+
+func (this *Store) write(oid string, buf []byte) error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	return ioctx.WriteFull(oid, buf)
+}
+
+// GetMeta returns the whole metadata object stored under the name.
+func (this *Store) GetMeta(name string) ([]byte, error) {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+
+	oid := this.prefix + name
+	stat, err := ioctx.Stat(oid)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, stat.Size)
+	n, err := ioctx.Read(oid, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// ListMeta returns names of metadata objects with the prefix in ascending
+// order.
+func (this *Store) ListMeta(prefix string) ([]string, error) {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+
+	var names []string
+	err = ioctx.ListObjects(func(oid string) {
+		if name, ok := api.Name(this.prefix, oid); ok && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (this *Store) DeleteMeta(name string) error {
+	return this.remove(this.prefix + name)
+}
+
+func (this *Store) remove(oid string) error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	return ioctx.Delete(oid)
+}
+
+// List calls fn for all objects with keys greater than after in ascending
+// order. Metadata objects and objects of other volumes are skipped. Unlike S3, RADOS lists objects in no
+// particular order, so all the keys are collected and sorted first.
+func (this *Store) List(after int64, fn func(key, size int64)) error {
+	ioctx, err := this.conn.OpenIOContext(this.pool)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	var keys []int64
+	err = ioctx.ListObjects(func(oid string) {
+		name, ok := api.Name(this.prefix, oid)
+		if !ok {
+			return
+		}
+		key, ok := api.Key(name)
+		if !ok || key <= after {
+			return
+		}
+		keys = append(keys, key)
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for _, key := range keys {
+		stat, err := ioctx.Stat(this.name(key))
+		if err != nil {
+			return err
+		}
+		fn(key, int64(stat.Size))
 	}
 
-	go func() { ioctx.Destroy() }()
+	return nil
 }
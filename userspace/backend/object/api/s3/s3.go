@@ -4,8 +4,8 @@
 package s3
 
 import (
-	"bufio"
 	"bytes"
+	"dis/backend/object/api"
 	"dis/parser"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,8 +13,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	"os"
-	"strconv"
+	"github.com/spf13/viper"
+	"io"
+	"io/ioutil"
 	"time"
 )
 
@@ -23,42 +24,92 @@ const (
 	envPrefix     = "dis_backend_object_s3"
 )
 
-var (
-	uploader      *s3manager.Uploader
-	downloader    *s3manager.Downloader
-	client        *s3.S3
-	bucket        string
-	remote        string
-	region        string
-	FnHeaderToMap func(header *[]byte, key, size int64)
-)
+// endpoint is the session to the remote, it is shared by all stores opened
+// from the same one.
+type endpoint struct {
+	uploader   *s3manager.Uploader
+	downloader *s3manager.Downloader
+	client     *s3.S3
+}
+
+// Store is a volume stored in a bucket. All object names of the volume start
+// with the prefix followed by the separator, so several volumes can share a
+// single bucket.
+type Store struct {
+	*endpoint
+	bucket string
+	prefix string
+}
+
+func Init(cfg *parser.Config) *Store {
+	return Configure(cfg.Sub(configSection), envPrefix)
+}
 
-func Init() {
-	v := parser.Sub(configSection)
+// Configure creates the store from another section of the configuration,
+// e.g. the one of a mirror.
+func Configure(v *viper.Viper, envPrefix string) *Store {
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("bucket")
+	v.BindEnv("prefix")
 	v.BindEnv("region")
 	v.BindEnv("remote")
-	bucket = v.GetString("bucket")
-	region = v.GetString("region")
-	remote = v.GetString("remote")
+	bucket := v.GetString("bucket")
+	prefix := v.GetString("prefix")
+	region := v.GetString("region")
+	remote := v.GetString("remote")
 
 	if bucket == "" || region == "" || remote == "" {
 		panic("")
 	}
 
-	connect()
+	return &Store{connect(remote, region), bucket, api.Prefix(prefix)}
+}
+
+// Open returns another volume accessible through the same endpoint.
+func (this *Store) Open(bucket, prefix string) *Store {
+	return &Store{this.endpoint, bucket, api.Prefix(prefix)}
+}
+
+func (this *Store) name(key int64) string {
+	return this.prefix + api.KeyName(key)
 }
 
-const keyFmt = "%08d"
+func (this *Store) Put(key int64, buf []byte) error {
+	return this.put(this.name(key), buf)
+}
+
+// PutMeta stores a metadata object, e.g. a checkpoint, under the name.
+func (this *Store) PutMeta(name string, buf []byte) error {
+	return this.put(this.prefix+name, buf)
+}
 
-func Upload(key int64, buf *[]byte) {
+func (this *Store) put(name string, buf []byte) error {
 	var err error
 	for i := 0; i < 200; i++ {
-		_, err = uploader.Upload(&s3manager.UploadInput{
-			Bucket: &bucket,
-			Key:    aws.String(fmt.Sprintf(keyFmt, key)),
-			Body:   bytes.NewReader(*buf),
+		_, err = this.uploader.Upload(&s3manager.UploadInput{
+			Bucket: &this.bucket,
+			Key:    aws.String(name),
+			Body:   bytes.NewReader(buf),
+		})
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Duration(i) * time.Millisecond)
+	}
+
+	return err
+}
+
+func (this *Store) GetRange(key int64, buf []byte, from int64) error {
+	rng := fmt.Sprintf("bytes=%d-%d", from, from+int64(len(buf))-1)
+	b := aws.NewWriteAtBuffer(buf)
+	var n int64
+	var err error
+	for i := 0; i < 200; i++ {
+		n, err = this.downloader.Download(b, &s3.GetObjectInput{
+			Bucket: &this.bucket,
+			Key:    aws.String(this.name(key)),
+			Range:  &rng,
 		})
 		if err == nil {
 			break
@@ -66,22 +117,25 @@ func Upload(key int64, buf *[]byte) {
 		time.Sleep(time.Duration(i) * time.Millisecond)
 	}
 	if err != nil {
-		panic(err)
+		return err
 	}
-}
 
-func Download(key int64, buf *[]byte, from, to int64) {
-	if to-from+1 != int64(len(*buf)) {
-		panic("")
+	// The range is cut at the end of the object
+	if n != int64(len(buf)) {
+		return io.ErrUnexpectedEOF
 	}
-	rng := fmt.Sprintf("bytes=%d-%d", from, to)
-	b := aws.NewWriteAtBuffer(*buf)
+
+	return nil
+}
+
+// GetMeta returns the whole metadata object stored under the name.
+func (this *Store) GetMeta(name string) ([]byte, error) {
+	var out *s3.GetObjectOutput
 	var err error
 	for i := 0; i < 200; i++ {
-		_, err = downloader.Download(b, &s3.GetObjectInput{
-			Bucket: &bucket,
-			Key:    aws.String(fmt.Sprintf(keyFmt, key)),
-			Range:  &rng,
+		out, err = this.client.GetObject(&s3.GetObjectInput{
+			Bucket: &this.bucket,
+			Key:    aws.String(this.prefix + name),
 		})
 		if err == nil {
 			break
@@ -89,29 +143,82 @@ func Download(key int64, buf *[]byte, from, to int64) {
 		time.Sleep(time.Duration(i) * time.Millisecond)
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer out.Body.Close()
+
+	return ioutil.ReadAll(out.Body)
 }
 
-func Delete(key int64) {
-	_, err := client.DeleteObject(&s3.DeleteObjectInput{Bucket: &bucket, Key: aws.String(fmt.Sprintf(keyFmt, key))})
+// ListMeta returns names of metadata objects with the prefix in ascending
+// order.
+func (this *Store) ListMeta(prefix string) ([]string, error) {
+	var names []string
+	err := this.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &this.bucket,
+		Prefix: aws.String(this.prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			if name, ok := api.Name(this.prefix, *o.Key); ok {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+
+	return names, nil
+}
+
+func (this *Store) DeleteMeta(name string) error {
+	_, err := this.client.DeleteObject(&s3.DeleteObjectInput{Bucket: &this.bucket, Key: aws.String(this.prefix + name)})
+	return err
 }
 
-func Void(key int64) {
-	_, err := uploader.Upload(&s3manager.UploadInput{
-		Bucket: &bucket,
-		Key:    aws.String(fmt.Sprintf(keyFmt, key)),
-		Body:   bytes.NewReader(make([]byte, 0)),
+// List calls fn for all objects with keys greater than after in ascending
+// order. Metadata objects and objects of other volumes are skipped.
+func (this *Store) List(after int64, fn func(key, size int64)) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: &this.bucket,
+		Prefix: &this.prefix,
+	}
+	if after >= 0 {
+		input.StartAfter = aws.String(this.name(after))
+	}
+
+	return this.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			name, ok := api.Name(this.prefix, *o.Key)
+			if !ok {
+				continue
+			}
+			key, ok := api.Key(name)
+			if !ok || key <= after {
+				continue
+			}
+			fn(key, *o.Size)
+		}
+		return true
 	})
+}
+
+func (this *Store) Delete(key int64) error {
+	_, err := this.client.DeleteObject(&s3.DeleteObjectInput{Bucket: &this.bucket, Key: aws.String(this.name(key))})
+	return err
+}
+
+func (this *Store) Head(key int64) (int64, error) {
+	out, err := this.client.HeadObject(&s3.HeadObjectInput{Bucket: &this.bucket, Key: aws.String(this.name(key))})
 	if err != nil {
-		fmt.Println(err)
+		return 0, err
 	}
+
+	return *out.ContentLength, nil
 }
 
-func connect() {
+func connect(remote, region string) *endpoint {
 	sess, err := session.NewSession(&aws.Config{
 		Endpoint:                      &remote,
 		Region:                        &region,
@@ -122,9 +229,8 @@ func connect() {
 		panic(err)
 	}
 
-	client = s3.New(sess)
-	uploader = s3manager.NewUploader(sess)
-	downloader = s3manager.NewDownloader(sess)
+	uploader := s3manager.NewUploader(sess)
+	downloader := s3manager.NewDownloader(sess)
 
 	uploader.Concurrency = 1
 	s3manager.WithUploaderRequestOptions(request.Option(func(r *request.Request) {
@@ -132,84 +238,65 @@ func connect() {
 	}))(uploader)
 	downloader.Concurrency = 1
 
-	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
-	if err == nil {
-		fmt.Println("Do you want to recover volume from", bucket, "? [Y/n]")
-		yn, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-
-		if yn == "N\n" || yn == "n\n" {
-			err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-				Bucket: &bucket,
-			}, func(page *s3.ListObjectsV2Output, last bool) bool {
-				for _, o := range page.Contents {
-					client.DeleteObject(&s3.DeleteObjectInput{Bucket: &bucket, Key: o.Key})
-				}
-				return true
-			})
-			if err != nil {
-				panic(err)
-			}
+	return &endpoint{uploader, downloader, s3.New(sess)}
+}
 
-			//_, err = client.DeleteBucket(&s3.DeleteBucketInput{Bucket: &bucket})
-			//if err != nil {
-			//	panic(err)
-			//}
-			//_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket})
-			//if err != nil {
-			//	panic(err)
-			//}
-			err = client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: &bucket})
-			if err != nil {
-				panic(err)
-			}
-			return
-		}
+// Exists returns true if the bucket exists.
+func (this *Store) Exists() bool {
+	_, err := this.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(this.bucket)})
+	return err == nil
+}
 
-		var lastKey int64 = -1
-		var finished bool
-		err = client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
-			Bucket: aws.String(bucket),
-		}, func(page *s3.ListObjectsV2Output, last bool) bool {
-			for _, o := range page.Contents {
-				key, _ := strconv.ParseInt(*o.Key, 10, 64)
-				if finished {
-					Delete(key)
-					continue
-				}
-				if lastKey != -1 && key != lastKey+1 {
-					finished = true
-					continue
-				}
-				lastKey = key
-				if *o.Size == 0 {
-					continue
-				}
-				headerSize := (*o.Size / 512) * 16
-				buf := make([]byte, headerSize)
-				Download(key, &buf, 0, headerSize-1)
-				FnHeaderToMap(&buf, key, *o.Size)
-			}
-			return true
-		})
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		var err error
-		for i := 0; i < 200; i++ {
-			_, err = client.CreateBucket(&s3.CreateBucketInput{Bucket: &bucket})
-			if err == nil {
-				break
+// Empty returns true if there are no objects of the volume in the bucket.
+func (this *Store) Empty() (bool, error) {
+	var empty = true
+	err := this.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &this.bucket,
+		Prefix: &this.prefix,
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			if _, ok := api.Name(this.prefix, *o.Key); ok {
+				empty = false
 			}
-			time.Sleep(time.Duration(i) * time.Millisecond)
-		}
-		if err != nil {
-			panic(err)
 		}
+		return empty
+	})
+
+	return empty, err
+}
+
+// Create creates the bucket if it does not exist yet.
+func (this *Store) Create() error {
+	if this.Exists() {
+		return nil
+	}
 
-		err = client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: &bucket})
-		if err != nil {
-			panic(err)
+	var err error
+	for i := 0; i < 200; i++ {
+		_, err = this.client.CreateBucket(&s3.CreateBucketInput{Bucket: &this.bucket})
+		if err == nil {
+			break
 		}
+		time.Sleep(time.Duration(i) * time.Millisecond)
+	}
+	if err != nil {
+		return err
 	}
+
+	return this.client.WaitUntilBucketExists(&s3.HeadBucketInput{Bucket: &this.bucket})
+}
+
+// Wipe deletes all objects of the volume in the bucket.
+func (this *Store) Wipe() error {
+	return this.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &this.bucket,
+		Prefix: &this.prefix,
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, o := range page.Contents {
+			if _, ok := api.Name(this.prefix, *o.Key); ok {
+				this.client.DeleteObject(&s3.DeleteObjectInput{Bucket: &this.bucket, Key: o.Key})
+			}
+		}
+		return true
+	})
 }
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/checkpoint"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	checkpointPrefix = "checkpoint-"
+	checkpointFmt    = checkpointPrefix + "%08d"
+	checkpointsKept  = 2
+)
+
+// checkpointer periodically stores the extent map into the object store so
+// the recovery does not need to replay headers of all objects.
+func (this *ObjectBackend) checkpointer() {
+	defer this.workers.Done()
+	if this.checkpointObjects == 0 && this.checkpointMinutes == 0 {
+		return
+	}
+
+	last := atomic.LoadInt64(&this.seqNumber)
+	lastTime := time.Now()
+	for this.sleep(time.Second) {
+
+		seq := atomic.LoadInt64(&this.seqNumber)
+		byObjects := this.checkpointObjects != 0 && seq-last >= this.checkpointObjects
+		byTime := this.checkpointMinutes != 0 && seq != last &&
+			time.Since(lastTime) >= time.Duration(this.checkpointMinutes)*time.Minute
+		if !byObjects && !byTime {
+			continue
+		}
+
+		seq, err := this.writeCheckpoint()
+		if err != nil {
+			fmt.Println("Checkpoint failed:", err)
+			continue
+		}
+		last = seq
+		lastTime = time.Now()
+	}
+}
+
+// writeCheckpoint uploads a checkpoint covering all objects with keys lower
+// than the current sequence number and returns that number.
+func (this *ObjectBackend) writeCheckpoint() (int64, error) {
+	// Objects of a GC run are covered only once the map points to them
+	this.gc.Collecting.Lock()
+	this.gc.Running.Lock()
+	cp := checkpoint.Checkpoint{
+		Volume:  this.volume,
+		Seq:     atomic.LoadInt64(&this.seqNumber),
+		Objects: this.gc.Sizes(),
+		Extents: this.em.Extents(),
+	}
+	this.gc.Running.Unlock()
+	this.gc.Collecting.Unlock()
+
+	// The map already points to objects which may still be uploading.
+	this.waitForUploads(cp.Seq)
+
+	buf := checkpoint.Encode(&cp)
+	name := fmt.Sprintf(checkpointFmt, cp.Seq)
+	if err := this.store.PutMeta(name, buf); err != nil {
+		return 0, err
+	}
+	fmt.Println("Checkpoint", name, "written")
+	this.replicateCheckpoint(name, buf)
+
+	// Old checkpoints are deleted again after the next one if this fails
+	names, err := this.store.ListMeta(checkpointPrefix)
+	if err != nil {
+		fmt.Println("Checkpoints not listed:", err)
+		return cp.Seq, nil
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-checkpointsKept; i++ {
+		if err := this.store.DeleteMeta(names[i]); err != nil {
+			fmt.Println("Checkpoint", names[i], "not deleted:", err)
+		}
+	}
+
+	return cp.Seq, nil
+}
+
+// waitForUploads blocks until all objects with keys lower than seq are
+// uploaded.
+func (this *ObjectBackend) waitForUploads(seq int64) {
+	for {
+		var busy bool
+		this.mutex.RLock()
+		for k := range this.uploading {
+			if k < seq {
+				busy = true
+				break
+			}
+		}
+		this.mutex.RUnlock()
+
+		if !busy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
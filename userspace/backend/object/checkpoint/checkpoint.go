@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package checkpoint
+
+import (
+	"bytes"
+	"dis/backend/object/extmap"
+	"dis/backend/object/gc"
+	"dis/backend/object/header"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Layout of a serialized checkpoint:
+//
+//	0   magic        [8]byte
+//	8   version      uint32
+//	12  crc          uint32 (CRC32C of the whole checkpoint with this field zeroed)
+//	16  volume       [16]byte
+//	32  seq          int64 (first key not covered by the checkpoint)
+//	40  objects      int64
+//	48  extents      int64
+//	56  objects      (key, total, physical) int64 triples
+//	... extents      (LBA, PBA, Len, Key) int64 quadruples
+const (
+	Version = 1
+
+	fixedSize  = 56
+	objectSize = 3 * 8
+	extentSize = 4 * 8
+)
+
+var (
+	magic = [8]byte{'D', 'I', 'S', 'C', 'K', 'P', 'T', 0}
+
+	ErrMagic    = errors.New("checkpoint: bad magic")
+	ErrVersion  = errors.New("checkpoint: unsupported version")
+	ErrChecksum = errors.New("checkpoint: checksum mismatch")
+	ErrShort    = errors.New("checkpoint: truncated")
+)
+
+// Checkpoint is the extent map and the object usage table as of key Seq, i.e.
+// it covers all objects with keys lower than Seq.
+type Checkpoint struct {
+	Volume  header.Volume
+	Seq     int64
+	Objects map[int64]gc.Size
+	Extents []extmap.Extent
+}
+
+func Encode(cp *Checkpoint) []byte {
+	keys := make([]int64, 0, len(cp.Objects))
+	for k := range cp.Objects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	size := fixedSize + len(keys)*objectSize + len(cp.Extents)*extentSize
+	buf := make([]byte, size)
+
+	copy(buf, magic[:])
+	binary.LittleEndian.PutUint32(buf[8:], Version)
+	copy(buf[16:32], cp.Volume[:])
+	binary.LittleEndian.PutUint64(buf[32:], uint64(cp.Seq))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(len(keys)))
+	binary.LittleEndian.PutUint64(buf[48:], uint64(len(cp.Extents)))
+
+	off := fixedSize
+	for _, k := range keys {
+		binary.LittleEndian.PutUint64(buf[off:], uint64(k))
+		binary.LittleEndian.PutUint64(buf[off+8:], uint64(cp.Objects[k].Total))
+		binary.LittleEndian.PutUint64(buf[off+16:], uint64(cp.Objects[k].Physical))
+		off += objectSize
+	}
+
+	for _, e := range cp.Extents {
+		binary.LittleEndian.PutUint64(buf[off:], uint64(e.LBA))
+		binary.LittleEndian.PutUint64(buf[off+8:], uint64(e.PBA))
+		binary.LittleEndian.PutUint64(buf[off+16:], uint64(e.Len))
+		binary.LittleEndian.PutUint64(buf[off+24:], uint64(e.Key))
+		off += extentSize
+	}
+
+	binary.LittleEndian.PutUint32(buf[12:], header.Sum(buf))
+
+	return buf
+}
+
+func Decode(buf []byte) (*Checkpoint, error) {
+	if len(buf) < fixedSize {
+		return nil, ErrShort
+	}
+	if !bytes.Equal(buf[:len(magic)], magic[:]) {
+		return nil, ErrMagic
+	}
+	if version := binary.LittleEndian.Uint32(buf[8:]); version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, version)
+	}
+
+	objects := int64(binary.LittleEndian.Uint64(buf[40:]))
+	extents := int64(binary.LittleEndian.Uint64(buf[48:]))
+	if objects < 0 || extents < 0 || int64(len(buf)) != fixedSize+objects*objectSize+extents*extentSize {
+		return nil, ErrShort
+	}
+
+	crc := binary.LittleEndian.Uint32(buf[12:])
+	binary.LittleEndian.PutUint32(buf[12:], 0)
+	sum := header.Sum(buf)
+	binary.LittleEndian.PutUint32(buf[12:], crc)
+	if crc != sum {
+		return nil, ErrChecksum
+	}
+
+	cp := &Checkpoint{
+		Seq:     int64(binary.LittleEndian.Uint64(buf[32:])),
+		Objects: make(map[int64]gc.Size, objects),
+		Extents: make([]extmap.Extent, extents),
+	}
+	copy(cp.Volume[:], buf[16:32])
+
+	off := fixedSize
+	for i := int64(0); i < objects; i++ {
+		k := int64(binary.LittleEndian.Uint64(buf[off:]))
+		cp.Objects[k] = gc.Size{
+			Total:    int64(binary.LittleEndian.Uint64(buf[off+8:])),
+			Physical: int64(binary.LittleEndian.Uint64(buf[off+16:])),
+		}
+		off += objectSize
+	}
+
+	for i := range cp.Extents {
+		e := &cp.Extents[i]
+		e.LBA = int64(binary.LittleEndian.Uint64(buf[off:]))
+		e.PBA = int64(binary.LittleEndian.Uint64(buf[off+8:]))
+		e.Len = int64(binary.LittleEndian.Uint64(buf[off+16:]))
+		e.Key = int64(binary.LittleEndian.Uint64(buf[off+24:]))
+		off += extentSize
+	}
+
+	return cp, nil
+}
@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package checkpoint
+
+import (
+	"dis/backend/object/extmap"
+	"dis/backend/object/gc"
+	"dis/backend/object/header"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testCheckpoint() *Checkpoint {
+	return &Checkpoint{
+		Volume: header.NewVolume(),
+		Seq:    10,
+		Objects: map[int64]gc.Size{
+			3: {Total: 2048, Physical: 2048},
+			7: {Total: 100, Physical: 40},
+		},
+		Extents: []extmap.Extent{
+			{LBA: 0, PBA: 16, Len: 8, Key: 3},
+			{LBA: 8, PBA: 24, Len: 100, Key: 7},
+			{LBA: 200, PBA: 32, Len: 4, Key: extmap.ForeignKey(1, 5)},
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	cp := testCheckpoint()
+	got, err := Decode(Encode(cp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cp) {
+		t.Fatalf("decoded %+v, encoded %+v", got, cp)
+	}
+
+	empty := &Checkpoint{Objects: map[int64]gc.Size{}, Extents: []extmap.Extent{}}
+	if got, err := Decode(Encode(empty)); err != nil || !reflect.DeepEqual(got, empty) {
+		t.Fatalf("decoded %+v, %v, encoded %+v", got, err, empty)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(buf []byte) []byte
+		want    error
+	}{
+		{"magic", func(buf []byte) []byte { buf[0] = 'X'; return buf }, ErrMagic},
+		{"version", func(buf []byte) []byte { buf[8] = 99; return buf }, ErrVersion},
+		{"seq", func(buf []byte) []byte { buf[32] ^= 1; return buf }, ErrChecksum},
+		{"extent", func(buf []byte) []byte { buf[len(buf)-1] ^= 1; return buf }, ErrChecksum},
+		{"truncated", func(buf []byte) []byte { return buf[:len(buf)-1] }, ErrShort},
+		{"extended", func(buf []byte) []byte { return append(buf, 0) }, ErrShort},
+		{"fixed part truncated", func(buf []byte) []byte { return buf[:fixedSize-1] }, ErrShort},
+		{"negative count", func(buf []byte) []byte { buf[47] = 0x80; return buf }, ErrShort},
+	}
+
+	for _, test := range tests {
+		buf := Encode(testCheckpoint())
+		if _, err := Decode(test.corrupt(buf)); !errors.Is(err, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"dis/backend/object/crypt"
+	"dis/backend/object/header"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+const (
+	infoCacheObjects = 4096
+	checksumRetries  = 3
+)
+
+// objectInfo holds checksums of the data blocks of a single object and its
+// frame table if it is compressed. Objects written without checksums have
+// sums set to nil, uncompressed objects have frames set to nil.
+type objectInfo struct {
+	dataStart int64
+	dataSize  int64
+	blockSize int64
+	sums      []uint32
+	frames    []header.Frame
+	cipher    uint8
+	nonce     crypt.Nonce
+	aad       []byte
+}
+
+func (this *ObjectBackend) initInfo() {
+	var err error
+	this.infoCache, err = lru.New(infoCacheObjects)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// infoOf returns checksums and frames of the object. They are downloaded from
+// the header of the object if they are not cached.
+func (this *ObjectBackend) infoOf(key int64) (*objectInfo, error) {
+	if s, ok := this.infoCache.Get(key); ok {
+		return s.(*objectInfo), nil
+	}
+
+	var err error
+	for i := 0; i <= checksumRetries; i++ {
+		var s *objectInfo
+		s, err = this.loadInfo(this.store, key)
+		if err == nil {
+			this.infoCache.Add(key, s)
+			return s, nil
+		}
+		fmt.Println("Object", key, "header unreadable:", err)
+	}
+
+	if this.secondary != nil {
+		s, serr := this.loadInfo(this.secondary, key)
+		if serr == nil {
+			fmt.Println("Object", key, "header read from the secondary store")
+			this.infoCache.Add(key, s)
+			return s, nil
+		}
+		err = fmt.Errorf("%v, secondary: %w", err, serr)
+	}
+
+	return nil, fmt.Errorf("object %v: %w", key, err)
+}
+
+func (this *ObjectBackend) loadInfo(st api.ObjectStore, key int64) (*objectInfo, error) {
+	fixed := make([]byte, header.FixedSize)
+	if err := this.downloadFrom(st, key, fixed, 0); err != nil {
+		return nil, err
+	}
+
+	h, err := header.ParseFixed(fixed)
+	if errors.Is(err, header.ErrMagic) {
+		if this.sealer != nil {
+			return nil, errPlain
+		}
+		return &objectInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if this.sealer != nil && h.Cipher == crypt.None {
+		return nil, errPlain
+	}
+
+	size := h.SumsSize()
+	if size == 0 {
+		return &objectInfo{}, nil
+	}
+
+	buf := make([]byte, size)
+	if err := this.downloadFrom(st, key, buf, h.SumOffset); err != nil {
+		return nil, err
+	}
+	sums, err := h.Sums(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var frames []header.Frame
+	if h.Frames != 0 {
+		// Encrypted frame tables are sealed together with the entries
+		from, size := h.FrameOffset, h.Frames*header.FrameSize
+		if h.Cipher != crypt.None {
+			from, size = h.EntryOffset, h.IndexSize
+		}
+		buf := make([]byte, size)
+		if err := this.downloadFrom(st, key, buf, from); err != nil {
+			return nil, err
+		}
+		if err := this.openIndex(h, buf); err != nil {
+			return nil, err
+		}
+		frames, err = h.FrameTable(buf[h.FrameOffset-from:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &objectInfo{h.Size, h.DataSize, h.BlockSize, sums, frames, h.Cipher, h.Nonce, h.AAD()}, nil
+}
+
+// align extends the byte range [from, to) to whole checksummed blocks.
+func (this *objectInfo) align(from, to int64) (int64, int64) {
+	if this.sums == nil {
+		return from, to
+	}
+
+	start, end := this.dataStart, this.dataStart+this.dataSize
+	if from > start && from < end {
+		from = start + (from-start)/this.blockSize*this.blockSize
+	}
+	if to > start && to < end {
+		to = start + (to-start+this.blockSize-1)/this.blockSize*this.blockSize
+		if to > end {
+			to = end
+		}
+	}
+
+	return from, to
+}
+
+// verify checks all blocks fully contained in buf, which starts at offset off
+// of the object. It returns the first corrupted block or -1.
+func (this *objectInfo) verify(buf []byte, off int64) int64 {
+	if this.sums == nil {
+		return -1
+	}
+
+	end := off + int64(len(buf))
+	first := int64(0)
+	if off > this.dataStart {
+		first = (off - this.dataStart) / this.blockSize
+	}
+	for i := first; i < int64(len(this.sums)); i++ {
+		from := this.dataStart + i*this.blockSize
+		if from >= end {
+			break
+		}
+		to := from + this.blockSize
+		if to > this.dataStart+this.dataSize {
+			to = this.dataStart + this.dataSize
+		}
+		if from < off || to > end {
+			continue
+		}
+		if header.Sum(buf[from-off:to-off]) != this.sums[i] {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// verifiedDownload downloads the byte range [from, to) of the object and
+// verifies it against the checksums stored in the object header. Corrupted
+// data are downloaded again, then from the secondary store if the objects are
+// mirrored, and if it does not help, an error is returned rather than passing
+// the data further.
+func (this *ObjectBackend) verifiedDownload(key int64, slice *[]byte, from, to int64) error {
+	s, err := this.infoOf(key)
+	if err != nil {
+		return err
+	}
+	bfrom, bto := s.align(from, to)
+
+	buf := *slice
+	if bfrom != from || bto != to {
+		buf = make([]byte, bto-bfrom)
+	}
+
+	for i := 0; ; i++ {
+		if err := this.download(key, buf, bfrom); err != nil {
+			return fmt.Errorf("object %v: %w", key, err)
+		}
+		bad := s.verify(buf, bfrom)
+		if bad < 0 {
+			break
+		}
+		if i == checksumRetries {
+			if this.secondary != nil && this.downloadFrom(this.secondary, key, buf, bfrom) == nil && s.verify(buf, bfrom) < 0 {
+				fmt.Println("Object", key, "read from the secondary store, checksum mismatch in block", bad)
+				break
+			}
+			return fmt.Errorf("object %v: checksum mismatch in block %v", key, bad)
+		}
+		fmt.Println("Object", key, "checksum mismatch in block", bad, "retrying")
+	}
+
+	if bfrom != from || bto != to {
+		copy(*slice, buf[from-bfrom:])
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"dis/backend/object/checkpoint"
+	"dis/backend/object/extmap"
+	"dis/backend/object/gc"
+	"dis/backend/object/header"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	parentSection   = "backend.object.parent"
+	parentEnvPrefix = "dis_backend_object_parent"
+
+	// Index of the parent volume in keys of the extent map
+	parentVolume = 1
+)
+
+var errNoParent = errors.New("volume is a clone but its parent is not configured")
+
+// download reads from the object of the volume the key belongs to.
+func (this *ObjectBackend) download(key int64, buf []byte, from int64) error {
+	return this.downloadFrom(this.store, key, buf, from)
+}
+
+// downloadFrom reads objects of the volume itself from st, e.g. from the
+// secondary store of a mirror.
+func (this *ObjectBackend) downloadFrom(st api.ObjectStore, key int64, buf []byte, from int64) error {
+	if vol, seq := extmap.SplitKey(key); vol == parentVolume {
+		if this.parent == nil {
+			return errNoParent
+		}
+		return this.parent.GetRange(seq, buf, from)
+	}
+
+	return st.GetRange(key, buf, from)
+}
+
+// loadParent fills the empty extent map of a new clone with the map of the
+// parent as of the snapshot or the sequence number. Unmodified ranges of the
+// clone are then read from objects of the parent.
+func (this *ObjectBackend) loadParent() error {
+	var extents []extmap.Extent
+	if this.parentSnapshot != "" {
+		buf, err := this.parent.GetMeta(snapshotPrefix + this.parentSnapshot)
+		if err != nil {
+			return err
+		}
+		cp, err := checkpoint.Decode(buf)
+		if err != nil {
+			return fmt.Errorf("parent snapshot %v is unreadable: %w", this.parentSnapshot, err)
+		}
+		extents = cp.Extents
+	} else {
+		fmt.Println("Cloning at sequence number", this.parentSeq, "objects may be collected by the parent")
+		var err error
+		extents, err = this.replayParent(this.parentSeq)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range extents {
+		e := &extents[i]
+		if vol, _ := extmap.SplitKey(e.Key); vol != 0 {
+			return errors.New("cloning of clones is not supported")
+		}
+		e.Key = extmap.ForeignKey(parentVolume, e.Key)
+		this.em.UpdateSingle(e)
+	}
+
+	fmt.Println("Cloned", len(extents), "extents of the parent")
+	return nil
+}
+
+// replayParent returns the extent map of the parent covering all its objects
+// with keys lower than seq.
+func (this *ObjectBackend) replayParent(seq int64) ([]extmap.Extent, error) {
+	// Objects of the parent are not accounted in the usage of the clone
+	m := extmap.New(gc.New())
+
+	var cut int64
+	names, err := this.parent.ListMeta(checkpointPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		buf, err := this.parent.GetMeta(name)
+		if err != nil {
+			return nil, err
+		}
+		cp, err := checkpoint.Decode(buf)
+		if err != nil || cp.Seq > seq {
+			continue
+		}
+		for i := range cp.Extents {
+			m.UpdateSingle(&cp.Extents[i])
+		}
+		cut = cp.Seq
+		break
+	}
+
+	// Objects collected by the parent are missing on purpose
+	collected, err := loadManifest(this.parent, header.Volume{})
+	if err != nil {
+		return nil, err
+	}
+
+	lastKey := cut - 1
+	var failed error
+	err = this.parent.List(lastKey, func(key, size int64) {
+		if failed != nil || key >= seq || collected.Contains(key) {
+			return
+		}
+		if (cut != 0 || lastKey != -1) && key != collected.Next(lastKey+1) {
+			failed = fmt.Errorf("parent is missing object %v", lastKey+1)
+			return
+		}
+		lastKey = key
+		if size == 0 {
+			return
+		}
+
+		buf, err := tryReadHeader(this.parent, key, size)
+		if err != nil {
+			failed = err
+			return
+		}
+		extents, _, _, _, err := this.headerExtents(buf, key, size)
+		if err != nil {
+			failed = err
+			return
+		}
+		for i := range extents {
+			m.UpdateSingle(&extents[i])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if failed != nil {
+		return nil, failed
+	}
+
+	return m.Extents(), nil
+}
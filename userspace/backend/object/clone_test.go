@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneWithoutParent(t *testing.T) {
+	p := newTestVolume(t, "")
+	b := p.open()
+	data := p.write(b, 0, 8)
+	p.close(b)
+
+	parent := fmt.Sprintf("[backend.object.parent]\npath = %q\nseq = 100\n", filepath.Join(p.dir, "store"))
+	c := newTestVolume(t, parent)
+	b = c.open()
+	c.check(b, 0, 8, data)
+	c.close(b)
+
+	c.configure("")
+	_, err := New(c.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: c.cfg, Cache: c.cache})
+	if !errors.Is(err, errNoParent) {
+		t.Fatal("clone recovered without its parent:", err)
+	}
+
+	c.configure(parent)
+	b = c.open()
+	c.check(b, 0, 8, data)
+	c.close(b)
+}
+
+func TestCloneOfMissingSnapshot(t *testing.T) {
+	p := newTestVolume(t, "")
+	b := p.open()
+	p.write(b, 0, 8)
+	p.close(b)
+
+	c := newTestVolume(t, fmt.Sprintf("[backend.object.parent]\npath = %q\nsnapshot = \"none\"\n", filepath.Join(p.dir, "store")))
+	_, err := New(c.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: c.cfg, Cache: c.cache})
+	if err == nil {
+		t.Fatal("clone of a missing snapshot created")
+	}
+}
+
+func TestCloneOfSnapshot(t *testing.T) {
+	p := newTestVolume(t, "")
+	b := p.open()
+	data := p.write(b, 0, 8)
+	// The snapshot is taken while the data are in the open object
+	if err := b.createSnapshot("s"); err != nil {
+		t.Fatal(err)
+	}
+	p.write(b, 0, 8)
+	p.close(b)
+
+	c := newTestVolume(t, fmt.Sprintf("[backend.object.parent]\npath = %q\nsnapshot = \"s\"\n", filepath.Join(p.dir, "store")))
+	b = c.open()
+	c.check(b, 0, 8, data)
+	c.close(b)
+}
@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package codec
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codecs are identified by a byte stored with every compressed frame.
+const (
+	None = 0
+	Zstd = 1
+	LZ4  = 2
+)
+
+var (
+	names = map[string]uint8{
+		"off":  None,
+		"zstd": Zstd,
+		"lz4":  LZ4,
+	}
+
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+)
+
+func init() {
+	var err error
+	encoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(err)
+	}
+	decoder, err = zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Parse returns the codec configured by its name.
+func Parse(name string) (uint8, error) {
+	if name == "" {
+		return None, nil
+	}
+	c, ok := names[name]
+	if !ok {
+		return None, fmt.Errorf("codec: unknown compression %q", name)
+	}
+
+	return c, nil
+}
+
+// Compress returns src compressed by the codec. The codec None is returned
+// together with src itself if the compression does not save any space.
+func Compress(c uint8, src []byte) ([]byte, uint8) {
+	var dst []byte
+	switch c {
+	case Zstd:
+		dst = encoder.EncodeAll(src, make([]byte, 0, len(src)))
+	case LZ4:
+		dst = make([]byte, lz4.CompressBlockBound(len(src)))
+		n, err := lz4.CompressBlock(src, dst, nil)
+		if err != nil || n == 0 {
+			return src, None
+		}
+		dst = dst[:n]
+	default:
+		return src, None
+	}
+
+	if len(dst) >= len(src) {
+		return src, None
+	}
+
+	return dst, c
+}
+
+// Decompress decompresses src into dst, which has to have exactly the size of
+// the original data.
+func Decompress(c uint8, dst, src []byte) error {
+	switch c {
+	case None:
+		if len(src) != len(dst) {
+			return fmt.Errorf("codec: raw frame of %v bytes, expected %v", len(src), len(dst))
+		}
+		copy(dst, src)
+	case Zstd:
+		out, err := decoder.DecodeAll(src, dst[:0])
+		if err != nil {
+			return err
+		}
+		if len(out) != len(dst) || &out[0] != &dst[0] {
+			return fmt.Errorf("codec: frame decompressed to %v bytes, expected %v", len(out), len(dst))
+		}
+	case LZ4:
+		n, err := lz4.UncompressBlock(src, dst)
+		if err != nil {
+			return err
+		}
+		if n != len(dst) {
+			return fmt.Errorf("codec: frame decompressed to %v bytes, expected %v", n, len(dst))
+		}
+	default:
+		return fmt.Errorf("codec: unknown codec %v", c)
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"dis/backend/object/header"
+	"dis/backend/object/manifest"
+	"fmt"
+)
+
+const manifestName = "manifest"
+
+// loadManifest reads the keys of objects collected from the store. A volume
+// without the manifest has none, objects collected by older versions are
+// replaced by empty ones instead.
+func loadManifest(st api.ObjectStore, vol header.Volume) (*manifest.Manifest, error) {
+	names, err := st.ListMeta(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	var found bool
+	for _, name := range names {
+		found = found || name == manifestName
+	}
+	if !found {
+		return &manifest.Manifest{Volume: vol}, nil
+	}
+
+	buf, err := st.GetMeta(manifestName)
+	if err != nil {
+		return nil, err
+	}
+	m, err := manifest.Decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("manifest is unreadable: %w", err)
+	}
+	if !vol.IsZero() && !m.Volume.IsZero() && vol != m.Volume {
+		return nil, fmt.Errorf("manifest belongs to volume %v, expected %v", m.Volume, vol)
+	}
+
+	return m, nil
+}
+
+// collected returns the current manifest. Manifests are never modified, a
+// changed copy replaces them.
+func (this *ObjectBackend) collected() *manifest.Manifest {
+	this.manifestMutex.Lock()
+	defer this.manifestMutex.Unlock()
+
+	return this.manifest
+}
+
+// updateManifest stores the manifest and makes it the current one.
+func (this *ObjectBackend) updateManifest(m *manifest.Manifest) error {
+	this.manifestMutex.Lock()
+	defer this.manifestMutex.Unlock()
+
+	m.Volume = this.volume
+	if err := this.store.PutMeta(manifestName, manifest.Encode(m)); err != nil {
+		return err
+	}
+	this.manifest = m
+
+	return nil
+}
+
+// collect deletes objects collected by the GC. They are recorded in the
+// manifest first, so the recovery does not take them for lost objects. If the
+// manifest cannot be updated, the objects are replaced by empty ones.
+func (this *ObjectBackend) collect(keys []int64) {
+	if len(keys) == 0 {
+		return
+	}
+
+	m := this.collected().With(keys)
+	if err := this.updateManifest(m); err != nil {
+		fmt.Println("Manifest not updated, voiding the objects instead:", err)
+		for _, key := range keys {
+			this.voidObject(key)
+		}
+		return
+	}
+
+	for _, key := range keys {
+		this.gcThrottle.Wait(0)
+		this.deleteObject(key)
+	}
+
+	this.replicateDeletion(m, keys)
+}
+
+// replicateDeletion repeats the update of the manifest and the deletion of the
+// objects on the replica.
+func (this *ObjectBackend) replicateDeletion(m *manifest.Manifest, keys []int64) {
+	buf := manifest.Encode(m)
+	this.replicateAfter(fmt.Sprint("Deletion of ", len(keys), " objects"), func(st api.ObjectStore) error {
+		if err := st.PutMeta(manifestName, buf); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			// Deleted already if the change is repeated
+			if _, err := st.Head(key); err != nil {
+				continue
+			}
+			if err := st.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
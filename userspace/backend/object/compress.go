@@ -0,0 +1,138 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/codec"
+	"dis/backend/object/crypt"
+	"dis/backend/object/header"
+	"fmt"
+	"sort"
+)
+
+// Extents are compressed in frames of at most frameSectors sectors, so a read
+// of a few sectors does not need to decompress the whole extent.
+const frameSectors = 128
+
+// pack returns the object with the data compressed and encrypted extent by
+// extent, or false if both are disabled or the compression alone does not
+// save any space. The map keeps addressing the data as if they were stored as
+// they are, i.e. PBAs are logical sectors.
+func (o *Object) pack(h *header.Header) ([]byte, bool) {
+	if o.b.compression == codec.None && o.b.sealer == nil {
+		return nil, false
+	}
+
+	aad := h.AAD()
+	var encrypt func(index []byte) []byte
+	var nonce crypt.Nonce
+	if o.b.sealer != nil {
+		nonce = crypt.NewNonce()
+		h.Cipher = o.b.sealer.ID()
+		h.Nonce = nonce
+		encrypt = func(index []byte) []byte {
+			return o.b.sealer.Seal(nonce, indexPiece, aad, index)
+		}
+	}
+
+	var frames []header.Frame
+	var data []byte
+
+	lsector := o.b.headerBlocks
+	for i := int64(0); i < o.extents; i++ {
+		_, length := header.GetEntry(*o.buf, o.b.objectSize, i)
+		if length < 0 {
+			// References have no data in this object
+			i++
+			continue
+		}
+		for done := int64(0); done < length; done += frameSectors {
+			n := length - done
+			if n > frameSectors {
+				n = frameSectors
+			}
+
+			out, c := codec.Compress(o.b.compression, (*o.buf)[lsector*512:(lsector+n)*512])
+			if o.b.sealer != nil {
+				out = o.b.sealer.Seal(nonce, uint32(len(frames)), aad, out)
+			}
+			frames = append(frames, header.Frame{
+				LSector:  lsector,
+				LSectors: n,
+				Offset:   int64(len(data)),
+				Len:      int64(len(out)),
+				Codec:    c,
+			})
+			data = append(data, out...)
+			lsector += n
+		}
+	}
+
+	if o.b.sealer == nil && header.FramedSize(o.extents, int64(len(frames)), int64(len(data)))+int64(len(data)) >= o.size() {
+		return nil, false
+	}
+
+	h.LogicalStart = o.b.headerBlocks * 512
+	entries := header.Entries(*o.buf, o.b.objectSize, o.extents)
+	o.frames = frames
+
+	return header.SealFramed(h, entries, frames, data, encrypt), true
+}
+
+// framedDownload reads the logical byte range [from, to) of a compressed or
+// encrypted object. All frames overlapping the range are downloaded at once,
+// verified and unpacked. Bytes not covered by any frame, i.e. the header and
+// the padding, read as zeros.
+func (this *ObjectBackend) framedDownload(key int64, info *objectInfo, buf []byte, from, to int64) error {
+	frames := info.frames
+	first := sort.Search(len(frames), func(i int) bool {
+		return (frames[i].LSector+frames[i].LSectors)*512 > from
+	})
+	last := first
+	for last < len(frames) && frames[last].LSector*512 < to {
+		last++
+	}
+
+	for i := range buf {
+		buf[i] = 0
+	}
+	if first == last {
+		return nil
+	}
+
+	pfrom := info.dataStart + frames[first].Offset
+	pto := info.dataStart + frames[last-1].Offset + frames[last-1].Len
+	packed := make([]byte, pto-pfrom)
+	if err := this.verifiedDownload(key, &packed, pfrom, pto); err != nil {
+		return err
+	}
+
+	for i := first; i < last; i++ {
+		f := &frames[i]
+		src := packed[info.dataStart+f.Offset-pfrom:][:f.Len]
+		if info.cipher != crypt.None {
+			var err error
+			src, err = this.sealer.Open(info.nonce, uint32(i), info.aad, src)
+			if err != nil {
+				return fmt.Errorf("object %v: frame %v: %w", key, i, err)
+			}
+		}
+
+		raw := make([]byte, f.LSectors*512)
+		if err := codec.Decompress(f.Codec, raw, src); err != nil {
+			return fmt.Errorf("object %v: %w", key, err)
+		}
+
+		lfrom, lto := f.LSector*512, (f.LSector+f.LSectors)*512
+		if lfrom < from {
+			lfrom = from
+		}
+		if lto > to {
+			lto = to
+		}
+		copy(buf[lfrom-from:lto-from], raw[lfrom-f.LSector*512:])
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"bytes"
+	"dis/backend/object/api"
+	"dis/backend/object/crypt"
+	"dis/backend/object/header"
+	"errors"
+	"fmt"
+)
+
+// Frames are sealed as pieces numbered from zero, the entries together with
+// the frame table as the last possible piece.
+const indexPiece = ^uint32(0)
+
+var (
+	metaMagic = []byte{'D', 'I', 'S', 'E', 'N', 'C', 0, 0}
+
+	errNoKey = errors.New("object is encrypted but no encryption is configured")
+	errAuth  = errors.New("metadata failed the authentication")
+	errPlain = errors.New("object is not encrypted but encryption is configured")
+)
+
+func (this *ObjectBackend) initCrypt(name, keyFile, key string) error {
+	var k []byte
+	if name != "" && name != "off" {
+		var err error
+		k, err = crypt.LoadKey(keyFile, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	this.sealer, err = crypt.New(name, k)
+	return err
+}
+
+// openIndex decrypts the entries and the frame table of an encrypted object in
+// place. Plaintext objects of an encrypted volume are refused, anybody with
+// access to the store could have written them.
+func (this *ObjectBackend) openIndex(h *header.Header, index []byte) error {
+	if h.Cipher == crypt.None {
+		if this.sealer != nil {
+			return errPlain
+		}
+		return nil
+	}
+	if this.sealer == nil || this.sealer.ID() != h.Cipher {
+		return errNoKey
+	}
+
+	_, err := this.sealer.Open(h.Nonce, indexPiece, h.AAD(), index)
+	return err
+}
+
+// metaCrypt encrypts metadata objects of the store too, as checkpoints and
+// snapshots contain the whole extent map. Sealed metadata start with the
+// volume they belong to, which is authenticated together with the name.
+type metaCrypt struct {
+	api.ObjectStore
+	sealer *crypt.Cipher
+	// Volume of the store, nil or zero if it is not known
+	volume *header.Volume
+}
+
+func (this *metaCrypt) PutMeta(name string, buf []byte) error {
+	if this.sealer == nil {
+		return this.ObjectStore.PutMeta(name, buf)
+	}
+
+	var vol header.Volume
+	if this.volume != nil {
+		vol = *this.volume
+	}
+	nonce := crypt.NewNonce()
+	sealed := append(append(append(append([]byte{}, metaMagic...), vol[:]...), nonce[:]...),
+		this.sealer.Seal(nonce, 0, metaAAD(vol, name), buf)...)
+	return this.ObjectStore.PutMeta(name, sealed)
+}
+
+// GetMeta passes plaintext metadata as they are if no encryption is
+// configured. Metadata which are plaintext, truncated, belong to another volume
+// or fail the authentication, e.g. because of a wrong key, are an errAuth
+// error.
+func (this *metaCrypt) GetMeta(name string) ([]byte, error) {
+	buf, err := this.ObjectStore.GetMeta(name)
+	if err != nil {
+		return nil, err
+	}
+	if this.sealer == nil {
+		if bytes.HasPrefix(buf, metaMagic) {
+			return nil, fmt.Errorf("metadata %v: %w", name, errNoKey)
+		}
+		return buf, nil
+	}
+	if !bytes.HasPrefix(buf, metaMagic) {
+		return nil, fmt.Errorf("metadata %v not encrypted: %w", name, errAuth)
+	}
+
+	var vol header.Volume
+	var nonce crypt.Nonce
+	if len(buf) < len(metaMagic)+len(vol)+crypt.NonceSize {
+		return nil, fmt.Errorf("metadata %v truncated: %w", name, errAuth)
+	}
+	buf = buf[len(metaMagic):]
+	copy(vol[:], buf)
+	copy(nonce[:], buf[len(vol):])
+	if this.volume != nil && !this.volume.IsZero() && vol != *this.volume {
+		return nil, fmt.Errorf("metadata %v belongs to volume %v: %w", name, vol, errAuth)
+	}
+
+	plain, err := this.sealer.Open(nonce, 0, metaAAD(vol, name), buf[len(vol)+crypt.NonceSize:])
+	if err != nil {
+		return nil, fmt.Errorf("metadata %v: %w: %v", name, errAuth, err)
+	}
+
+	return plain, nil
+}
+
+func metaAAD(vol header.Volume, name string) []byte {
+	return append(append([]byte{}, vol[:]...), name...)
+}
+
+// checkKey fails if the metadata of the store cannot be opened with the
+// configured key, or without one, before the recovery takes the objects for
+// corrupted. Only the first metadata object of every kind is read.
+func (this *metaCrypt) checkKey() error {
+	if !this.Exists() {
+		return nil
+	}
+
+	for _, prefix := range []string{checkpointPrefix, snapshotPrefix, journalPrefix, manifestName} {
+		names, err := this.ListMeta(prefix)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		if _, err := this.GetMeta(names[0]); errors.Is(err, errNoKey) || errors.Is(err, errAuth) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Ciphers are identified by a byte stored in the header of every encrypted
+// object.
+const (
+	None              = 0
+	AESGCM            = 1
+	XChaCha20Poly1305 = 2
+
+	KeySize   = 32
+	NonceSize = chacha20poly1305.NonceSizeX
+)
+
+var names = map[string]uint8{
+	"off":                None,
+	"aes-gcm":            AESGCM,
+	"xchacha20-poly1305": XChaCha20Poly1305,
+}
+
+// Nonce is a random base of nonces of a single object. Every piece of the
+// object is sealed with its own nonce derived from the base and the index of
+// the piece.
+type Nonce [NonceSize]byte
+
+type Cipher struct {
+	id   uint8
+	aead cipher.AEAD
+}
+
+// New returns the cipher configured by its name or nil if the encryption is
+// disabled.
+func New(name string, key []byte) (*Cipher, error) {
+	id, ok := names[name]
+	if name == "" {
+		id, ok = None, true
+	}
+	if !ok {
+		return nil, fmt.Errorf("crypt: unknown encryption %q", name)
+	}
+	if id == None {
+		return nil, nil
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("crypt: key has %v bytes, expected %v", len(key), KeySize)
+	}
+
+	var aead cipher.AEAD
+	var err error
+	switch id {
+	case AESGCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case XChaCha20Poly1305:
+		aead, err = chacha20poly1305.NewX(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{id, aead}, nil
+}
+
+// LoadKey returns the key read from the file or, if no file is given, the hex
+// encoded key.
+func LoadKey(file, key string) ([]byte, error) {
+	if file != "" {
+		buf, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) == KeySize {
+			return buf, nil
+		}
+		key = string(buf)
+	}
+
+	return hex.DecodeString(strings.TrimSpace(key))
+}
+
+func NewNonce() Nonce {
+	var n Nonce
+	if _, err := rand.Read(n[:]); err != nil {
+		panic(err)
+	}
+
+	return n
+}
+
+func (this *Cipher) ID() uint8 {
+	return this.id
+}
+
+func (this *Cipher) Overhead() int {
+	return this.aead.Overhead()
+}
+
+func (this *Cipher) nonce(base Nonce, index uint32) []byte {
+	n := make([]byte, this.aead.NonceSize())
+	copy(n, base[:])
+	last := n[len(n)-4:]
+	binary.BigEndian.PutUint32(last, binary.BigEndian.Uint32(last)^index)
+
+	return n
+}
+
+// Seal encrypts and authenticates the index-th piece of an object.
+func (this *Cipher) Seal(base Nonce, index uint32, aad, plain []byte) []byte {
+	return this.aead.Seal(make([]byte, 0, len(plain)+this.Overhead()), this.nonce(base, index), plain, aad)
+}
+
+// Open decrypts the index-th piece of an object in place and returns the
+// plaintext.
+func (this *Cipher) Open(base Nonce, index uint32, aad, sealed []byte) ([]byte, error) {
+	return this.aead.Open(sealed[:0], this.nonce(base, index), sealed, aad)
+}
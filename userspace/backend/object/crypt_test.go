@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"bytes"
+	"dis/backend"
+	"dis/backend/object/api/memory"
+	"dis/backend/object/crypt"
+	"dis/backend/object/header"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testCipher(t *testing.T, fill byte) *crypt.Cipher {
+	c, err := crypt.New("aes-gcm", bytes.Repeat([]byte{fill}, crypt.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestMetaCrypt(t *testing.T) {
+	st := memory.New(0)
+	vol := header.NewVolume()
+	sealed := &metaCrypt{st, testCipher(t, 1), &vol}
+
+	data := []byte("extent map")
+	if err := sealed.PutMeta("checkpoint-00000001", data); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := sealed.GetMeta("checkpoint-00000001")
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	if buf, err := (&metaCrypt{st, testCipher(t, 1), nil}).GetMeta("checkpoint-00000001"); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read without the volume %q: %v", buf, err)
+	}
+
+	if _, err := (&metaCrypt{st, testCipher(t, 2), &vol}).GetMeta("checkpoint-00000001"); !errors.Is(err, errAuth) {
+		t.Errorf("wrong key: %v", err)
+	}
+	other := header.NewVolume()
+	if _, err := (&metaCrypt{st, testCipher(t, 1), &other}).GetMeta("checkpoint-00000001"); !errors.Is(err, errAuth) {
+		t.Errorf("other volume: %v", err)
+	}
+	plain := &metaCrypt{st, nil, &vol}
+	if _, err := plain.GetMeta("checkpoint-00000001"); !errors.Is(err, errNoKey) {
+		t.Errorf("no key: %v", err)
+	}
+	if err := plain.checkKey(); !errors.Is(err, errNoKey) {
+		t.Errorf("no key check: %v", err)
+	}
+
+	raw, err := st.GetMeta("checkpoint-00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The volume is bound to the data
+	forged := append([]byte{}, raw...)
+	copy(forged[len(metaMagic):], other[:])
+	if err := st.PutMeta("checkpoint-00000001", forged); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&metaCrypt{st, testCipher(t, 1), nil}).GetMeta("checkpoint-00000001"); !errors.Is(err, errAuth) {
+		t.Errorf("volume replaced: %v", err)
+	}
+	for _, n := range []int{len(metaMagic) + 1, len(raw) - 1} {
+		if err := st.PutMeta("checkpoint-00000001", raw[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sealed.GetMeta("checkpoint-00000001"); !errors.Is(err, errAuth) {
+			t.Errorf("truncated to %v bytes: %v", n, err)
+		}
+	}
+
+	// Plaintext metadata are refused once encryption is configured
+	if err := plain.PutMeta("manifest", data); err != nil {
+		t.Fatal(err)
+	}
+	if buf, err := plain.GetMeta("manifest"); err != nil || !bytes.Equal(buf, data) {
+		t.Fatalf("read %q: %v", buf, err)
+	}
+	if _, err := sealed.GetMeta("manifest"); !errors.Is(err, errAuth) {
+		t.Errorf("plaintext accepted: %v", err)
+	}
+}
+
+func TestOpenWithoutKey(t *testing.T) {
+	key := strings.Repeat("01", crypt.KeySize)
+	tv := newTestVolume(t, `encryption = "aes-gcm"`+"\nkey = \""+key+"\"\ncheckpointObjects = 1")
+
+	b := tv.open()
+	tv.write(b, 0, 1000)
+	tv.close(b)
+
+	tv.configure("checkpointObjects = 1")
+	_, err := New(tv.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: tv.cfg, Cache: tv.cache})
+	if !errors.Is(err, errNoKey) {
+		t.Fatalf("volume opened without the key: %v", err)
+	}
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	settings := `encryption = "aes-gcm"` + "\nkey = \"%v\"\ncheckpointObjects = %v"
+	for _, checkpoints := range []int{0, 1} {
+		tv := newTestVolume(t, fmt.Sprintf(settings, strings.Repeat("01", crypt.KeySize), checkpoints))
+		b := tv.open()
+		for i := int64(0); i < 4; i++ {
+			tv.write(b, i*1024, 1024)
+		}
+		tv.close(b)
+		before := tv.objects()
+
+		tv.configure(fmt.Sprintf(settings, strings.Repeat("02", crypt.KeySize), checkpoints))
+		_, err := New(tv.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: tv.cfg, Cache: tv.cache})
+		if err == nil {
+			t.Fatal("volume opened with a wrong key")
+		}
+		if after := tv.objects(); len(after) != len(before) {
+			t.Fatalf("%v objects left of %v", len(after), len(before))
+		}
+	}
+}
+
+func TestOpenPlaintextWithKey(t *testing.T) {
+	for _, checkpoints := range []int{0, 1} {
+		tv := newTestVolume(t, fmt.Sprintf("checkpointObjects = %v", checkpoints))
+		b := tv.open()
+		for i := int64(0); i < 4; i++ {
+			tv.write(b, i*1024, 1024)
+		}
+		tv.close(b)
+		before := tv.objects()
+
+		tv.configure(fmt.Sprintf("encryption = \"aes-gcm\"\nkey = \"%v\"\ncheckpointObjects = %v", strings.Repeat("01", crypt.KeySize), checkpoints))
+		_, err := New(tv.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: tv.cfg, Cache: tv.cache})
+		if err == nil {
+			t.Fatal("plaintext volume opened with encryption configured")
+		}
+		if after := tv.objects(); len(after) != len(before) {
+			t.Fatalf("%v objects left of %v", len(after), len(before))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"crypto/sha256"
+	"dis/backend/object/extmap"
+	"dis/backend/object/header"
+
+	"github.com/hashicorp/golang-lru"
+)
+
+// Blocks of dedupSectors sectors aligned by LBA are deduplicated, the rest is
+// always stored.
+const dedupSectors = 8
+
+type fingerprint [sha256.Size]byte
+
+// blockRef is the location of a stored block.
+type blockRef struct {
+	key int64
+	pba int64
+}
+
+// pendingBlock is a block of an object which is not uploaded yet.
+type pendingBlock struct {
+	fp  fingerprint
+	pba int64
+}
+
+// segment is a part of a written extent which is either stored or references
+// already stored data. Stored segments carry fingerprints of their blocks,
+// offsets of the blocks are in sectors from the start of the segment.
+type segment struct {
+	lba    int64
+	len    int64
+	ref    *blockRef
+	blocks []pendingBlock
+}
+
+func (this *ObjectBackend) initDedup(entries int) {
+	if entries <= 0 {
+		entries = 1 << 20
+	}
+
+	var err error
+	this.fingerprints, err = lru.New(entries)
+	if err != nil {
+		panic(err)
+	}
+	this.gc.EnableRefs(this.objectSize / 512)
+}
+
+// planDedup splits the written extent into segments. Objects referenced by
+// the segments are pinned, so they are not collected before the extent map
+// is updated.
+func (this *ObjectBackend) planDedup(lba int64, buf []byte) []segment {
+	var segs []segment
+	store := func(lba, length int64, b *pendingBlock) {
+		if n := len(segs); n > 0 && segs[n-1].ref == nil {
+			s := &segs[n-1]
+			if b != nil {
+				b.pba = s.len
+				s.blocks = append(s.blocks, *b)
+			}
+			s.len += length
+			return
+		}
+		s := segment{lba: lba, len: length}
+		if b != nil {
+			s.blocks = append(s.blocks, *b)
+		}
+		segs = append(segs, s)
+	}
+	reference := func(lba int64, r blockRef) {
+		if n := len(segs); n > 0 && segs[n-1].ref != nil {
+			s := &segs[n-1]
+			if s.ref.key == r.key && s.ref.pba+s.len == r.pba {
+				s.len += dedupSectors
+				return
+			}
+		}
+		this.gc.Pin(r.key)
+		segs = append(segs, segment{lba: lba, len: dedupSectors, ref: &r})
+	}
+
+	this.gc.Running.Lock()
+	defer this.gc.Running.Unlock()
+
+	end := lba + int64(len(buf))/512
+	for s := lba; s < end; {
+		if s%dedupSectors != 0 || s+dedupSectors > end {
+			n := dedupSectors - s%dedupSectors
+			if s+n > end {
+				n = end - s
+			}
+			store(s, n, nil)
+			s += n
+			continue
+		}
+
+		off := (s - lba) * 512
+		fp := fingerprint(sha256.Sum256(buf[off : off+dedupSectors*512]))
+		if v, ok := this.fingerprints.Get(fp); ok {
+			r := v.(blockRef)
+			if this.gc.Alive(r.key) {
+				reference(s, r)
+				s += dedupSectors
+				continue
+			}
+			this.fingerprints.Remove(fp)
+		}
+		store(s, dedupSectors, &pendingBlock{fp: fp})
+		s += dedupSectors
+	}
+
+	return segs
+}
+
+// addRef appends a reference to already stored data to the object.
+func (o *Object) addRef(lba, length int64, r *blockRef) {
+	*o.writelist = append(*o.writelist, &extmap.Extent{
+		LBA: lba,
+		PBA: r.pba,
+		Len: length,
+		Key: r.key})
+
+	o.putRef(lba, length, r.key, r.pba)
+	o.pins = append(o.pins, r.key)
+}
+
+// addCopy records in the header of a GC object that the extent at lba shares
+// the data the GC already copied to pba of the target, so the recovery maps it
+// as well. References to the object itself get the key once it is assigned.
+func (o *Object) addCopy(lba, length int64, target *Object, pba int64) {
+	if target == o {
+		o.selfRefs = append(o.selfRefs, selfRef{o.extents, pba})
+	}
+	o.putRef(lba, length, target.key, pba)
+}
+
+// putRef stores the reference in the header, which is not part of the buffer
+// yet if the object holds no data.
+func (o *Object) putRef(lba, length, key, pba int64) {
+	*o.buf = (*o.buf)[:o.blocks*512]
+	header.PutRef(*o.buf, o.b.objectSize, o.extents, lba, length, key, pba)
+	o.extents += 2
+}
+
+// fitsRef returns true if the header has room for a reference.
+func (o *Object) fitsRef() bool {
+	return o.extents+2 <= o.b.objectSize/512
+}
+
+// fits returns true if the object has room for the segment.
+func (o *Object) fits(s *segment) bool {
+	if s.ref != nil {
+		return o.fitsRef()
+	}
+
+	return o.size()+s.len*512 <= o.b.objectSize
+}
+
+// publish makes blocks of the object available for deduplication and
+// releases objects it references. It has to be called after the extent map
+// is updated.
+func (o *Object) publish() {
+	for _, b := range o.fresh {
+		o.b.fingerprints.Add(b.fp, blockRef{o.key, b.pba})
+	}
+	for _, k := range o.pins {
+		o.b.gc.Unpin(k)
+	}
+}
@@ -11,9 +11,12 @@ import (
 	"sync"
 )
 
+// ExtentMap maps the volume to objects. Changes of the map are accounted in
+// the usage of the objects.
 type ExtentMap struct {
 	rbt   *redblacktree.Tree
 	mutex sync.RWMutex
+	usage *gc.Collector
 }
 
 type Extent struct {
@@ -23,8 +26,21 @@ type Extent struct {
 	Key int64
 }
 
-func New() *ExtentMap {
-	m := ExtentMap{rbt: redblacktree.NewWith(utils.Int64Comparator)}
+// Objects of other volumes, e.g. of the parent of a clone, are referenced by
+// keys with the index of the volume in the upper bits. Objects of the volume
+// itself have index zero.
+const volumeShift = 48
+
+func ForeignKey(vol, key int64) int64 {
+	return vol<<volumeShift | key
+}
+
+func SplitKey(key int64) (vol, seq int64) {
+	return key >> volumeShift, key & (1<<volumeShift - 1)
+}
+
+func New(usage *gc.Collector) *ExtentMap {
+	m := ExtentMap{rbt: redblacktree.NewWith(utils.Int64Comparator), usage: usage}
 	return &m
 }
 
@@ -80,6 +96,35 @@ func (this *ExtentMap) GenerateWritelist(purgeList *map[int64]bool) *[]*Extent {
 	return writelist
 }
 
+// Relocate points the parts of the extent which still map the same data to
+// their copy at pba of the object key. Parts changed since the extent was
+// copied are left as they are.
+func (this *ExtentMap) Relocate(e *Extent, key, pba int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, f := range *this.find(&Extent{e.LBA, e.PBA, e.Len, e.Key}) {
+		if f.Key != e.Key || f.PBA-f.LBA != e.PBA-e.LBA {
+			continue
+		}
+		this.update(&Extent{f.LBA, pba + f.LBA - e.LBA, f.Len, key})
+	}
+}
+
+// Extents returns a copy of all extents in the map ordered by LBA.
+func (this *ExtentMap) Extents() []Extent {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	extents := make([]Extent, 0, this.rbt.Size())
+	it := this.rbt.Iterator()
+	for it.Next() {
+		extents = append(extents, *it.Value().(*Extent))
+	}
+
+	return extents
+}
+
 func (this *ExtentMap) insert(e *Extent)  {
 	this.rbt.Put(e.LBA, e)
 }
@@ -127,8 +172,9 @@ func (this *ExtentMap) update(e *Extent) {
 			}
 			n.PBA = geq.PBA + geq.Len - n.Len
 
-			gc.Free(geq.Key, n.Len)
-			gc.Add(n.Key, n.Len)
+			this.usage.Free(geq.Key, n.PBA, n.Len)
+			this.usage.Add(n.Key, n.PBA, n.Len)
+			this.usage.Free(geq.Key, geq.PBA+e.LBA-geq.LBA, e.Len)
 
 			geq.Len = e.LBA - geq.LBA
 			this.insert(n)
@@ -136,7 +182,7 @@ func (this *ExtentMap) update(e *Extent) {
 			node = this.geq(geq)
 
 		} else if geq.LBA < e.LBA {
-			gc.Free(geq.Key, geq.Len-e.LBA+geq.LBA)
+			this.usage.Free(geq.Key, geq.PBA+e.LBA-geq.LBA, geq.Len-e.LBA+geq.LBA)
 			geq.Len = e.LBA - geq.LBA
 			geq = this.next(geq)
 			node = this.geq(geq)
@@ -145,7 +191,7 @@ func (this *ExtentMap) update(e *Extent) {
 		for geq != nil && geq.LBA+geq.Len <= e.LBA+e.Len {
 			tmp := this.next(geq)
 			this.remove(geq)
-			gc.Free(geq.Key, geq.Len)
+			this.usage.Free(geq.Key, geq.PBA, geq.Len)
 			geq = tmp
 			node = this.geq(geq)
 		}
@@ -156,12 +202,12 @@ func (this *ExtentMap) update(e *Extent) {
 			node.Key = geq.LBA
 			geq.PBA += n
 			geq.Len -= n
-			gc.Free(geq.Key, n)
+			this.usage.Free(geq.Key, geq.PBA-n, n)
 		}
 	}
 
 	this.insert(&Extent{e.LBA, e.PBA, e.Len, e.Key})
-	gc.Add(e.Key, e.Len)
+	this.usage.Add(e.Key, e.PBA, e.Len)
 }
 
 func (this *ExtentMap) find(e *Extent) *[]*Extent {
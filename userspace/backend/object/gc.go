@@ -4,29 +4,33 @@
 package object
 
 import (
-	"dis/backend/object/api/s3"
+	"dis/backend/object/api"
 	"dis/backend/object/extmap"
 	"dis/backend/object/gc"
+	"dis/backend/object/journal"
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func getDownloadChan() chan downloadJob {
+func (this *ObjectBackend) getDownloadChan() chan downloadJob {
 	ch := make(chan downloadJob)
 	for i := 0; i < 5; i++ {
 		go func() {
 			for c := range ch {
 				for {
-					mutex.RLock()
-					wait := uploading[c.e.Key]
-					mutex.RUnlock()
+					this.mutex.RLock()
+					wait := this.uploading[c.e.Key]
+					this.mutex.RUnlock()
 					if wait != true {
 						break
 					}
 					time.Sleep(500 * time.Microsecond)
 				}
-				partDownload(c.e, c.buf)
+				this.gcThrottle.Wait(c.e.Len * 512)
+				c.failed.set(this.partDownload(c.e, c.buf))
 				c.reads.Done()
 			}
 		}()
@@ -35,15 +39,29 @@ func getDownloadChan() chan downloadJob {
 	return ch
 }
 
-func getUploadChan() (chan *Object, *sync.WaitGroup) {
+// getUploadChan returns workers uploading objects of the GC run. Once any
+// download of the run failed, objects are uploaded empty, as their keys are
+// already taken and a gap would end the recovery.
+func (this *ObjectBackend) getUploadChan(failed *failure) (chan *Object, *sync.WaitGroup) {
 	ch := make(chan *Object)
 	var uploadsWG sync.WaitGroup
 	for i := 0; i < 5; i++ {
 		go func() {
 			for c := range ch {
 				c.reads.Wait()
-				*c.buf = (*c.buf)[:cap(*c.buf)]
-				s3.Upload(c.key, c.buf)
+				if failed.get() != nil {
+					*c.buf = (*c.buf)[:0]
+				} else {
+					*c.buf = (*c.buf)[:cap(*c.buf)]
+					c.seal()
+				}
+				retry(fmt.Sprint("Upload of object ", c.key), func() error {
+					this.gcThrottle.Wait(int64(len(*c.buf)))
+					return this.store.Put(c.key, *c.buf)
+				})
+				this.mutex.Lock()
+				delete(this.uploading, c.key)
+				this.mutex.Unlock()
 				uploadsWG.Done()
 			}
 		}()
@@ -52,194 +70,343 @@ func getUploadChan() (chan *Object, *sync.WaitGroup) {
 	return ch, &uploadsWG
 }
 
-func gcthread() {
-	if gcMode != "on" && gcMode != "silent" {
+const (
+	gcPeriod = 5 * time.Second
+	// Memory for the buffers of a GC run if gcMemoryM is not set
+	defaultGCMemory = 512 * 1024 * 1024
+)
+
+// gcthread collects the victims downloading their data straight into the new
+// objects. A victim takes the memory of its live data in the new objects.
+func (this *ObjectBackend) gcthread() {
+	this.gcLoop(this.gcRun, func(c gc.Candidate) int64 {
+		return c.Used * 512
+	})
+}
+
+// gcthread2 downloads the live data of the victims before packing them into
+// the new objects. A victim takes at most its whole data for the download and
+// the memory of its live data in the new objects.
+func (this *ObjectBackend) gcthread2() {
+	this.gcLoop(this.gcRun2, func(c gc.Candidate) int64 {
+		return (c.Total + c.Used) * 512
+	})
+}
+
+func (this *ObjectBackend) gcLoop(run func(*map[int64]bool) error, cost func(gc.Candidate) int64) {
+	defer this.workers.Done()
+	if this.gcMode != "on" && this.gcMode != "silent" {
 		return
 	}
-	const gcPeriod = 5 * time.Second
-	for {
-		time.Sleep(gcPeriod)
-		if !gc.Needed() {
+	for this.sleep(gcPeriod) {
+		if !this.gc.Needed() {
 			continue
 		}
-		gc.Running.Lock()
-		em.RLock()
-		fmt.Println("GC Started")
-		purgeSet := gc.GetPurgeSetGreedy()
-		fmt.Println("Objects viable for GC: ", len(*purgeSet))
-		wl := em.GenerateWritelist(purgeSet)
-		newPBAs := make([]int64, len(*wl))
-		newKeys := make([]int64, len(*wl))
-		slicedKeys := newKeys
-
-		downloader := getDownloadChan()
-		uploader, uploadsWG := getUploadChan()
-
-		o := nextObject(true)
-		upload := func() {
-			if o.extents == 0 {
-				return
-			}
-			o.assignKey()
-
-			var i int64
-			for i = 0; i < o.extents; i++ {
-				slicedKeys[i] = o.key
-			}
-			slicedKeys = slicedKeys[i:]
-
-			uploadsWG.Add(1)
-			uploader <- o
-			o = nextObject(true)
-		}
-
-		for i, e := range *wl {
-			if o.size()+e.Len*512 > objectSize {
-				upload()
-			}
-
-			newPBAs[i] = o.blocks
-			slice := o.add(e.LBA, e.Len, true)
-
-			o.reads.Add(1)
-			go func(o *Object, e *extmap.Extent) {
-				downloader <- downloadJob{e, &slice, o.reads}
-			}(o, e)
+		// The GC waits for the foreground latency before taking the locks
+		if this.gcThrottle.Pause() {
+			fmt.Println("GC postponed, foreground latency was high")
+			continue
 		}
-		upload()
+		this.gc.Running.Lock()
+		this.em.RLock()
 
-		uploadsWG.Wait()
-		em.RUnlock()
-		em.Lock()
+		fmt.Println("GC Started")
+		purgeSet := this.gc.PurgeSet(this.gcPolicy)
+		fmt.Println("Objects viable for GC: ", len(*purgeSet))
 
-		for i, e := range *wl {
-			e.PBA = newPBAs[i]
-			e.Key = newKeys[i]
-			gc.Add(e.Key, e.Len)
+		this.gc.Running.Unlock()
+		this.em.RUnlock()
+		if len(*purgeSet) == 0 {
+			continue
 		}
 
-		em.Unlock()
-		gc.Running.Unlock()
-
-		for key := range *purgeSet {
-			s3.Void(key)
-			gc.Destroy(key)
+		if err := this.runBatches(purgeSet, cost, run); err != nil {
+			fmt.Println("GC aborted:", err)
+			continue
 		}
 
 		fmt.Println("GC Done")
 	}
 }
 
-func gcthread2() {
-	if gcMode != "on" && gcMode != "silent" {
-		return
+// runBatches splits the victims into batches whose cost fits into gcMemory,
+// minus an object the run is filling, and collects them by separate runs. A
+// batch holds at least one victim. Batches collected before a failure or the
+// shutdown stay collected.
+func (this *ObjectBackend) runBatches(purgeSet *map[int64]bool, cost func(gc.Candidate) int64, run func(*map[int64]bool) error) error {
+	costs := make(map[int64]int64, len(*purgeSet))
+	for _, c := range this.gc.Candidates() {
+		if (*purgeSet)[c.Key] {
+			costs[c.Key] = cost(c)
+		}
 	}
-	const gcPeriod = 5 * time.Second
-	for {
-		time.Sleep(gcPeriod)
-		if !gc.Needed() {
-			continue
+	keys := make([]int64, 0, len(*purgeSet))
+	for k := range *purgeSet {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var batches []map[int64]bool
+	var size int64
+	budget := this.gcMemory - this.objectSize
+	for _, k := range keys {
+		if len(batches) == 0 || size+costs[k] > budget {
+			batches = append(batches, make(map[int64]bool))
+			size = 0
 		}
-		gc.Running.Lock()
-		em.RLock()
-
-		fmt.Println("GC Started")
-		purgeSet := gc.GetPurgeSetGreedy()
-		fmt.Println("Objects viable for GC: ", len(*purgeSet))
+		batches[len(batches)-1][k] = true
+		size += costs[k]
+	}
+	if len(batches) > 1 {
+		fmt.Println("GC runs in", len(batches), "batches")
+	}
 
-		gc.Running.Unlock()
-		em.RUnlock()
+	for _, batch := range batches {
+		this.gcThrottle.Pause()
+		if err := run(&batch); err != nil {
+			return err
+		}
 
-		downloader := getDownloadChan()
+		select {
+		case <-this.done:
+			return nil
+		default:
+		}
+	}
 
-		// Buffer for downloaded objects
-		buffer := make(map[int64][]byte)
+	return nil
+}
 
-		// WaitGroup for running downloads
-		var wg sync.WaitGroup
+func (this *ObjectBackend) gcRun(purgeSet *map[int64]bool) error {
+	return this.collectVictims(purgeSet, nil)
+}
 
-		for k, _ := range *purgeSet {
-			// Object
-			b := make([]byte, objectSize)
+// move is an extent of a victim and the place the GC copies it to.
+type move struct {
+	from extmap.Extent
+	o    *Object
+	pba  int64
+}
 
-			// Extent for the whole object
-			e := extmap.Extent{
-				LBA: 0,
-				PBA: 0,
-				Len: objectSize / 512,
-				Key: k,
-			}
+// collectVictims copies the live data of the victims into new objects, which
+// are packed and get their keys under the GC lock. The data missing in the
+// spans are downloaded and the objects uploaded without the lock, so the
+// throttling of the GC does not hold up the writer. The extent map is switched
+// to the copies under the lock again, except for data overwritten meanwhile.
+func (this *ObjectBackend) collectVictims(purgeSet *map[int64]bool, spans map[int64]*span) error {
+	this.gc.Collecting.Lock()
+	defer this.gc.Collecting.Unlock()
+	this.gc.Running.Lock()
+	this.em.RLock()
+
+	// Snapshots might have been created since the victims were selected
+	this.gc.DropPinned(purgeSet)
+	wl := this.em.GenerateWritelist(purgeSet)
+	moves := make([]move, len(*wl))
+	copies := make(map[extmap.Extent]int)
+	failed := new(failure)
+
+	first := atomic.LoadInt64(&this.seqNumber)
+	var objects []*Object
+	var downloads []downloadJob
+	o := this.nextObject(true)
+	pack := func() {
+		if o.extents == 0 {
+			return
+		}
+		o.assignKey()
+		objects = append(objects, o)
+		o = this.nextObject(true)
+	}
 
-			wg.Add(1)
-			downloader <- downloadJob{&e, &b, &wg}
+	for i, e := range *wl {
+		moves[i].from = *e
 
-			// Store object to buffer.
-			//
-			// Does not need to wait for download, just slice is
-			// copied and waiting is done after the end of the loop.
-			buffer[k] = b
+		// Ranges shared by the deduplication stay shared
+		src := extmap.Extent{PBA: e.PBA, Len: e.Len, Key: e.Key}
+		if j, ok := copies[src]; ok {
+			if !o.fitsRef() {
+				pack()
+			}
+			o.addCopy(e.LBA, e.Len, moves[j].o, moves[j].pba)
+			moves[i].o, moves[i].pba = moves[j].o, moves[j].pba
+			continue
 		}
-		wg.Wait()
+		copies[src] = i
 
-		gc.Running.Lock()
-		em.RLock()
+		if o.size()+e.Len*512 > this.objectSize {
+			pack()
+		}
 
-		wl := em.GenerateWritelist(purgeSet)
-		newPBAs := make([]int64, len(*wl))
-		newKeys := make([]int64, len(*wl))
-		slicedKeys := newKeys
+		moves[i].o, moves[i].pba = o, o.blocks
+		slice := o.add(e.LBA, e.Len, true)
 
-		uploader, uploadsWG := getUploadChan()
+		// Deduplicated writes may refer to other data of the victim since
+		// the spans were downloaded
+		if !spans[e.Key].copyTo(slice, e) {
+			o.reads.Add(1)
+			downloads = append(downloads, downloadJob{&moves[i].from, &slice, o.reads, failed})
+		}
+	}
+	pack()
+	this.em.RUnlock()
+
+	// The record has to be stored before the writer can upload objects with
+	// later keys, as the recovery would take missing objects of the run for
+	// the end of the volume otherwise.
+	record, err := this.beginGC(purgeSet, first, atomic.LoadInt64(&this.seqNumber))
+	if err != nil {
+		// No other keys were assigned meanwhile
+		for _, o := range objects {
+			this.gc.Destroy(o.key)
+		}
+		atomic.StoreInt64(&this.seqNumber, first)
+		this.gc.Running.Unlock()
+		return err
+	}
+	this.gc.Retire(record.Victims)
+	this.mutex.Lock()
+	for _, o := range objects {
+		this.uploading[o.key] = true
+	}
+	this.mutex.Unlock()
+	this.gc.Running.Unlock()
+
+	downloader := this.getDownloadChan()
+	uploader, uploadsWG := this.getUploadChan(failed)
+	go func() {
+		for _, d := range downloads {
+			downloader <- d
+		}
+	}()
+	for _, o := range objects {
+		uploadsWG.Add(1)
+		uploader <- o
+	}
+	uploadsWG.Wait()
+	close(downloader)
+	close(uploader)
 
-		o := nextObject(true)
-		upload := func() {
-			if o.extents == 0 {
-				return
-			}
-			o.assignKey()
+	if err := failed.get(); err != nil {
+		this.abortRun(record, objects)
+		return err
+	}
 
-			var i int64
-			for i = 0; i < o.extents; i++ {
-				slicedKeys[i] = o.key
-			}
-			slicedKeys = slicedKeys[i:]
+	this.commitGC(record)
+	this.gc.Running.Lock()
+	for i := range moves {
+		this.em.Relocate(&moves[i].from, moves[i].o.key, moves[i].pba)
+	}
+	// Deduplication must not reference the objects anymore
+	for key := range *purgeSet {
+		this.gc.Destroy(key)
+	}
+	this.gc.Running.Unlock()
 
-			uploadsWG.Add(1)
-			uploader <- o
-			o = nextObject(true)
-		}
+	this.collect(record.Victims)
+	for key := range *purgeSet {
+		this.infoCache.Remove(key)
+	}
+	this.endGC(record)
 
-		for i, e := range *wl {
-			if o.size()+e.Len*512 > objectSize {
-				upload()
-			}
+	return nil
+}
 
-			newPBAs[i] = o.blocks
-			slice := o.add(e.LBA, e.Len, true)
+// abortRun drops the objects uploaded empty by a failed run and makes the
+// victims alive again.
+func (this *ObjectBackend) abortRun(record *journal.Record, objects []*Object) {
+	var created []int64
+	for _, o := range objects {
+		created = append(created, o.key)
+	}
+	// Copies uploaded before the failure are not referenced
+	for _, key := range created {
+		this.gc.Destroy(key)
+	}
+	this.abortGC(record)
+	this.gc.Revive(record.Victims)
+	this.collect(created)
+	for _, key := range created {
+		this.infoCache.Remove(key)
+	}
+}
 
-			// Just copy needed extents from buffered objects
-			copy(slice, buffer[e.Key][e.PBA*512:(e.PBA+e.Len)*512])
-		}
-		upload()
+// voidObject replaces a collected object by an empty one, which the recovery
+// skips as well. A failure only leaves the space unreclaimed.
+func (this *ObjectBackend) voidObject(key int64) {
+	this.gcThrottle.Wait(0)
+	if err := this.store.Put(key, nil); err != nil {
+		fmt.Println("Object", key, "not voided:", err)
+		return
+	}
+	this.replicateAfter(fmt.Sprint("Void of object ", key), func(st api.ObjectStore) error {
+		return st.Put(key, nil)
+	})
+}
 
-		uploadsWG.Wait()
-		em.RUnlock()
-		em.Lock()
+// span is the part of a victim holding all its live data, which is downloaded
+// by a single request.
+type span struct {
+	e   extmap.Extent
+	buf []byte
+}
 
-		for i, e := range *wl {
-			e.PBA = newPBAs[i]
-			e.Key = newKeys[i]
-			gc.Add(e.Key, e.Len)
+// liveSpans returns spans of the victims referred to by the writelist.
+// Victims without live data are not downloaded at all.
+func liveSpans(wl *[]*extmap.Extent) map[int64]*span {
+	spans := make(map[int64]*span)
+	for _, e := range *wl {
+		s := spans[e.Key]
+		if s == nil {
+			spans[e.Key] = &span{e: extmap.Extent{PBA: e.PBA, Len: e.Len, Key: e.Key}}
+			continue
+		}
+		end := s.e.PBA + s.e.Len
+		if e.PBA+e.Len > end {
+			end = e.PBA + e.Len
+		}
+		if e.PBA < s.e.PBA {
+			s.e.PBA = e.PBA
 		}
+		s.e.Len = end - s.e.PBA
+	}
+	for _, s := range spans {
+		s.buf = make([]byte, s.e.Len*512)
+	}
 
-		em.Unlock()
-		gc.Running.Unlock()
+	return spans
+}
 
-		for key := range *purgeSet {
-			s3.Void(key)
-			gc.Destroy(key)
-		}
+// copyTo copies the data of the extent from the span. It returns false if the
+// extent is not in the span.
+func (this *span) copyTo(slice []byte, e *extmap.Extent) bool {
+	if this == nil || e.PBA < this.e.PBA || e.PBA+e.Len > this.e.PBA+this.e.Len {
+		return false
+	}
+	copy(slice, this.buf[(e.PBA-this.e.PBA)*512:])
 
-		fmt.Println("GC Done")
+	return true
+}
+
+func (this *ObjectBackend) gcRun2(purgeSet *map[int64]bool) error {
+	this.em.RLock()
+	this.gc.DropPinned(purgeSet)
+	spans := liveSpans(this.em.GenerateWritelist(purgeSet))
+	this.em.RUnlock()
+
+	failed := new(failure)
+	downloader := this.getDownloadChan()
+	var wg sync.WaitGroup
+	for _, s := range spans {
+		this.gcThrottle.Pause()
+		wg.Add(1)
+		downloader <- downloadJob{&s.e, &s.buf, &wg, failed}
 	}
+	wg.Wait()
+	close(downloader)
+	if err := failed.get(); err != nil {
+		return err
+	}
+
+	return this.collectVictims(purgeSet, spans)
 }
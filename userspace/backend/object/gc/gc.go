@@ -5,8 +5,7 @@ package gc
 
 import (
 	"fmt"
-	"github.com/emirpasic/gods/trees/redblacktree"
-	"github.com/emirpasic/gods/utils"
+	"math"
 	"sync"
 	"sync/atomic"
 )
@@ -14,120 +13,249 @@ import (
 const ratio = 0.2
 const gcTarget = 0.3
 
-var (
-	mutex   sync.RWMutex
-	usage   = make(map[int64]*objectUsage)
-	Running = new(sync.Mutex)
-	total   int64
-	valid   int64
-	statcnt int64
-)
+// Collector tracks the usage of objects of a single volume. Running is held
+// while keys are assigned and the extent map is updated by the writer or by
+// the GC. Collecting is held by a GC run while it copies and deletes its
+// victims, and by everything capturing the extent map as a whole. It is taken
+// before Running.
+type Collector struct {
+	Collecting sync.Mutex
+	Running    sync.Mutex
+
+	mutex    sync.RWMutex
+	usage    map[int64]*objectUsage
+	pinned   map[int64]int
+	retired  map[int64]bool
+	total    int64
+	valid    int64
+	physical int64
+	statcnt  int64
+
+	refSectors int64
+}
 
+func New() *Collector {
+	return &Collector{
+		usage:   make(map[int64]*objectUsage),
+		pinned:  make(map[int64]int),
+		retired: make(map[int64]bool),
+	}
+}
+
+// refs count references to every sector of the object if the reference
+// counting is enabled. Counts which reach the maximum are never decremented.
 type objectUsage struct {
-	total int64
-	used  int64
+	total    int64
+	used     int64
+	physical int64
+	refs     []uint16
 }
 
-func Free(key, size int64) {
-	mutex.RLock()
-	o := usage[key]
-	mutex.RUnlock()
+// Size is the logical size of an object together with the size of its data
+// as stored, which differs for compressed objects. Both are in sectors.
+type Size struct {
+	Total    int64
+	Physical int64
+}
+
+// EnableRefs makes the usage reference counted, so more extents can share
+// the same sectors of an object. Objects have at most sectors sectors.
+func (this *Collector) EnableRefs(sectors int64) {
+	this.refSectors = sectors
+}
+
+// Free and Add ignore objects which are not tracked, e.g. objects of the
+// parent of a clone. Calls of both have to be serialized, which the extent
+// map does.
+func (this *Collector) Free(key, pba, size int64) {
+	this.mutex.RLock()
+	o := this.usage[key]
+	this.mutex.RUnlock()
+	if o == nil {
+		return
+	}
+
+	if o.refs != nil {
+		size = o.ref(pba, size, -1)
+	}
 
 	atomic.AddInt64(&o.used, -size)
-	atomic.AddInt64(&valid, -size)
+	atomic.AddInt64(&this.valid, -size)
 }
 
-func Add(key, size int64) {
-	mutex.RLock()
-	o := usage[key]
-	mutex.RUnlock()
+func (this *Collector) Add(key, pba, size int64) {
+	this.mutex.RLock()
+	o := this.usage[key]
+	this.mutex.RUnlock()
+	if o == nil {
+		return
+	}
+
+	if o.refs != nil {
+		size = o.ref(pba, size, 1)
+	} else {
+		atomic.AddInt64(&this.total, size)
+	}
 
 	atomic.AddInt64(&o.used, size)
-	atomic.AddInt64(&total, size)
-	atomic.AddInt64(&valid, size)
+	atomic.AddInt64(&this.valid, size)
 }
 
-func Create(key, total int64) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// ref changes reference counts of the sectors and returns the number of
+// sectors which became referenced or unreferenced.
+func (this *objectUsage) ref(pba, size int64, delta int) int64 {
+	var changed int64
+	for i := pba; i < pba+size && i < int64(len(this.refs)); i++ {
+		r := &this.refs[i]
+		if *r == math.MaxUint16 {
+			continue
+		}
+		if delta > 0 {
+			*r++
+			if *r == 1 {
+				changed++
+			}
+		} else if *r > 0 {
+			*r--
+			if *r == 0 {
+				changed++
+			}
+		}
+	}
 
-	usage[key] = &objectUsage{total, 0}
+	return changed
 }
 
-func Destroy(key int64) {
-	mutex.Lock()
-	defer mutex.Unlock()
+func (this *Collector) Create(key, size int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	o := &objectUsage{size, 0, size, nil}
+	if this.refSectors != 0 {
+		o.refs = make([]uint16, this.refSectors)
+		atomic.AddInt64(&this.total, size)
+	}
+	this.usage[key] = o
+	atomic.AddInt64(&this.physical, size)
+}
 
-	o := usage[key]
+// Alive returns true if the object is tracked and not collected yet.
+func (this *Collector) Alive(key int64) bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 
-	atomic.AddInt64(&valid, -o.used)
-	atomic.AddInt64(&total, -o.total)
-	delete(usage, key)
+	return this.usage[key] != nil && !this.retired[key]
 }
 
-func PrintStats(delay int64, gcMode string) {
-	total := atomic.LoadInt64(&total)
-	valid := atomic.LoadInt64(&valid)
-	garbage := total - valid
+// Retire marks victims of a running GC, which must not be referenced anymore
+// although they are still tracked.
+func (this *Collector) Retire(keys []int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-	fmt.Printf("STATS: %v,%v,%v,%v,%v,%v\n", statcnt, total, valid, garbage, float64(garbage)/float64(total), gcMode)
+	for _, k := range keys {
+		this.retired[k] = true
+	}
+}
 
-	statcnt += delay
+// Revive makes victims of a failed GC run alive again.
+func (this *Collector) Revive(keys []int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, k := range keys {
+		delete(this.retired, k)
+	}
 }
 
-func Needed() bool {
-	total := atomic.LoadInt64(&total)
-	valid := atomic.LoadInt64(&valid)
-	garbage := total - valid
+// SetPhysical records the size of the object data as stored.
+func (this *Collector) SetPhysical(key, size int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-	if float64(garbage)/float64(total) >= gcTarget {
-		return true
+	o := this.usage[key]
+	if o == nil {
+		return
 	}
-	return false
+
+	atomic.AddInt64(&this.physical, size-o.physical)
+	o.physical = size
 }
 
-func GetPurgeSetGreedy() *map[int64]bool {
-	t := redblacktree.NewWith(func(a, b interface{}) int {
-		return -utils.Int64Comparator(a, b)
-	})
+func (this *Collector) Destroy(key int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-	purgeSet := map[int64]bool{}
+	o := this.usage[key]
 
-	mutex.RLock()
-	for k, v := range usage {
-		t.Put(v.total-v.used, k)
-	}
-	mutex.RUnlock()
-
-	total := atomic.LoadInt64(&total)
-	valid := atomic.LoadInt64(&valid)
-	invalid := total - valid
-	toCollect := float64(invalid) - gcTarget*float64(total)
-
-	it := t.Iterator()
-	for it.Next() {
-		k := it.Value().(int64)
-		purgeSet[k] = true
-		invalid := it.Key().(int64)
-		toCollect -= float64(invalid)
-		if toCollect < 0 {
-			break
-		}
+	atomic.AddInt64(&this.valid, -o.used)
+	atomic.AddInt64(&this.total, -o.total)
+	atomic.AddInt64(&this.physical, -o.physical)
+	delete(this.usage, key)
+	delete(this.retired, key)
+}
+
+// Sizes returns sizes of all tracked objects.
+func (this *Collector) Sizes() map[int64]Size {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	sizes := make(map[int64]Size, len(this.usage))
+	for k, v := range this.usage {
+		sizes[k] = Size{v.total, v.physical}
 	}
 
-	return &purgeSet
+	return sizes
+}
+
+// Pin protects the object from being collected, e.g. because a snapshot needs
+// it. Pins are counted, the object is protected until it is unpinned by all.
+func (this *Collector) Pin(key int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.pinned[key]++
+}
+
+func (this *Collector) Unpin(key int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.pinned[key]--; this.pinned[key] <= 0 {
+		delete(this.pinned, key)
+	}
 }
 
-func GetPurgeSetUniform() *map[int64]bool {
-	purgeSet := map[int64]bool{}
+// DropPinned removes objects pinned in the meantime from the purge set.
+func (this *Collector) DropPinned(purgeSet *map[int64]bool) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
 
-	mutex.RLock()
-	for k, v := range usage {
-		if r := float64(v.used) / float64(v.total); r < ratio {
-			purgeSet[k] = true
+	for k := range *purgeSet {
+		if this.pinned[k] > 0 {
+			delete(*purgeSet, k)
 		}
 	}
-	mutex.RUnlock()
+}
+
+func (this *Collector) PrintStats(delay int64, gcMode string) {
+	total := atomic.LoadInt64(&this.total)
+	valid := atomic.LoadInt64(&this.valid)
+	physical := atomic.LoadInt64(&this.physical)
+	garbage := total - valid
+
+	fmt.Printf("STATS: %v,%v,%v,%v,%v,%v,%v\n", this.statcnt, total, valid, garbage, float64(garbage)/float64(total), gcMode, physical)
+
+	this.statcnt += delay
+}
+
+func (this *Collector) Needed() bool {
+	total := atomic.LoadInt64(&this.total)
+	valid := atomic.LoadInt64(&this.valid)
+	garbage := total - valid
 
-	return &purgeSet
+	if float64(garbage)/float64(total) >= gcTarget {
+		return true
+	}
+	return false
 }
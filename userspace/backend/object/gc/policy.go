@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package gc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Candidate is an object the GC may collect. Sizes are in sectors, the age is
+// the number of objects written after the object.
+type Candidate struct {
+	Key   int64
+	Total int64
+	Used  int64
+	Age   int64
+}
+
+func (this *Candidate) garbage() int64 {
+	return this.Total - this.Used
+}
+
+func (this *Candidate) utilization() float64 {
+	if this.Total == 0 {
+		return 0
+	}
+	return float64(this.Used) / float64(this.Total)
+}
+
+// Policy selects objects to collect out of the candidates. It should select
+// objects holding at least toCollect sectors of garbage, if there are enough.
+type Policy func(candidates []Candidate, toCollect float64) map[int64]bool
+
+var policies = map[string]Policy{
+	"greedy":       Greedy,
+	"uniform":      Uniform,
+	"cost-benefit": CostBenefit,
+	"oldest-first": OldestFirst,
+}
+
+// ParsePolicy returns the policy of the name, the default one if it is empty.
+func ParsePolicy(name string) (Policy, error) {
+	if name == "" {
+		return Greedy, nil
+	}
+	if p := policies[name]; p != nil {
+		return p, nil
+	}
+
+	names := make([]string, 0, len(policies))
+	for n := range policies {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return nil, fmt.Errorf("unknown gcPolicy %q, available policies: %v", name, strings.Join(names, ", "))
+}
+
+// Greedy selects objects with the most garbage first.
+func Greedy(candidates []Candidate, toCollect float64) map[int64]bool {
+	return takeBest(candidates, toCollect, func(a, b *Candidate) bool {
+		return a.garbage() > b.garbage()
+	})
+}
+
+// Uniform selects all objects utilized less than the ratio, regardless of the
+// amount of garbage to collect.
+func Uniform(candidates []Candidate, toCollect float64) map[int64]bool {
+	purgeSet := map[int64]bool{}
+	for i := range candidates {
+		if candidates[i].utilization() < ratio {
+			purgeSet[candidates[i].Key] = true
+		}
+	}
+
+	return purgeSet
+}
+
+// CostBenefit selects objects as the LFS cleaner does. Old objects are
+// preferred even if they hold less garbage, as their data are unlikely to be
+// overwritten soon and would fragment the young objects otherwise.
+//
+//	benefit / cost = (1 - u) * age / (1 + u)
+func CostBenefit(candidates []Candidate, toCollect float64) map[int64]bool {
+	score := func(c *Candidate) float64 {
+		u := c.utilization()
+		return (1 - u) * float64(c.Age+1) / (1 + u)
+	}
+
+	return takeBest(candidates, toCollect, func(a, b *Candidate) bool {
+		return score(a) > score(b)
+	})
+}
+
+// OldestFirst selects objects in the order they were written, as a cleaner of
+// a circular log does.
+func OldestFirst(candidates []Candidate, toCollect float64) map[int64]bool {
+	return takeBest(candidates, toCollect, func(a, b *Candidate) bool {
+		return a.Age > b.Age
+	})
+}
+
+// takeBest selects objects with garbage in the order given by better until
+// enough garbage is collected. Ties are broken by keys, so the selection does
+// not depend on the order of the candidates.
+func takeBest(candidates []Candidate, toCollect float64, better func(a, b *Candidate) bool) map[int64]bool {
+	sorted := make([]Candidate, 0, len(candidates))
+	for _, c := range candidates {
+		if c.garbage() > 0 {
+			sorted = append(sorted, c)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := &sorted[i], &sorted[j]
+		if better(a, b) {
+			return true
+		}
+		if better(b, a) {
+			return false
+		}
+		return a.Key < b.Key
+	})
+
+	purgeSet := map[int64]bool{}
+	for i := range sorted {
+		if toCollect < 0 {
+			break
+		}
+		purgeSet[sorted[i].Key] = true
+		toCollect -= float64(sorted[i].garbage())
+	}
+
+	return purgeSet
+}
+
+// Candidates returns all objects which are not pinned.
+func (this *Collector) Candidates() []Candidate {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	var newest int64
+	for k := range this.usage {
+		if k > newest {
+			newest = k
+		}
+	}
+
+	candidates := make([]Candidate, 0, len(this.usage))
+	for k, v := range this.usage {
+		if this.pinned[k] > 0 {
+			continue
+		}
+		candidates = append(candidates, Candidate{k, v.total, atomic.LoadInt64(&v.used), newest - k})
+	}
+
+	return candidates
+}
+
+// PurgeSet selects objects to collect by the policy, so the ratio of garbage
+// drops to the target.
+func (this *Collector) PurgeSet(policy Policy) *map[int64]bool {
+	total := atomic.LoadInt64(&this.total)
+	valid := atomic.LoadInt64(&this.valid)
+	toCollect := float64(total-valid) - gcTarget*float64(total)
+
+	purgeSet := policy(this.Candidates(), toCollect)
+	return &purgeSet
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package gc
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Key 1 holds the most garbage, key 2 is the oldest and key 3 is almost
+// empty but holds little garbage. Key 4 is fully used.
+var candidates = []Candidate{
+	{Key: 1, Total: 100, Used: 40, Age: 1},
+	{Key: 2, Total: 100, Used: 70, Age: 30},
+	{Key: 3, Total: 10, Used: 1, Age: 2},
+	{Key: 4, Total: 100, Used: 100, Age: 40},
+}
+
+func keys(k ...int64) map[int64]bool {
+	m := map[int64]bool{}
+	for _, k := range k {
+		m[k] = true
+	}
+	return m
+}
+
+func TestPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    Policy
+		toCollect float64
+		want      map[int64]bool
+	}{
+		{"greedy", Greedy, 50, keys(1)},
+		{"greedy more", Greedy, 61, keys(1, 2)},
+		{"greedy all", Greedy, 1000, keys(1, 2, 3)},
+		{"greedy nothing", Greedy, -1, keys()},
+		{"uniform", Uniform, 0, keys(3)},
+		{"uniform ignores the amount", Uniform, 1000, keys(3)},
+		{"cost-benefit", CostBenefit, 20, keys(2)},
+		{"cost-benefit prefers old objects", CostBenefit, 35, keys(2, 3)},
+		{"oldest-first", OldestFirst, 20, keys(2)},
+		{"oldest-first skips full objects", OldestFirst, 35, keys(2, 3)},
+	}
+
+	for _, test := range tests {
+		got := test.policy(candidates, test.toCollect)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPolicyTies(t *testing.T) {
+	tied := []Candidate{
+		{Key: 7, Total: 10, Used: 5},
+		{Key: 5, Total: 10, Used: 5},
+		{Key: 6, Total: 10, Used: 5},
+	}
+	for _, policy := range []Policy{Greedy, CostBenefit, OldestFirst} {
+		if got := policy(tied, 4); !reflect.DeepEqual(got, keys(5)) {
+			t.Errorf("got %v, want the lowest key", got)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		want Policy
+	}{
+		{"", Greedy},
+		{"greedy", Greedy},
+		{"uniform", Uniform},
+		{"cost-benefit", CostBenefit},
+		{"oldest-first", OldestFirst},
+		{"newest-first", nil},
+	}
+
+	for _, test := range tests {
+		p, err := ParsePolicy(test.name)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: unknown policy accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.name, err)
+			continue
+		}
+		if reflect.ValueOf(p).Pointer() != reflect.ValueOf(test.want).Pointer() {
+			t.Errorf("%q: wrong policy", test.name)
+		}
+	}
+}
+
+func TestPurgeSet(t *testing.T) {
+	c := New()
+	for k, used := range map[int64]int64{1: 20, 2: 60, 3: 100} {
+		c.Create(k, 100)
+		c.Add(k, 0, 100)
+		c.Free(k, 0, 100-used)
+	}
+
+	// 120 of 300 sectors are garbage, 30 % are kept
+	if got := *c.PurgeSet(Greedy); !reflect.DeepEqual(got, keys(1)) {
+		t.Errorf("got %v, want %v", got, keys(1))
+	}
+
+	c.Pin(1)
+	if got := *c.PurgeSet(Greedy); !reflect.DeepEqual(got, keys(2)) {
+		t.Errorf("pinned object selected: %v", got)
+	}
+	c.Unpin(1)
+
+	c.Destroy(1)
+	if got := *c.PurgeSet(Greedy); len(got) != 0 {
+		t.Errorf("got %v, want nothing to collect", got)
+	}
+}
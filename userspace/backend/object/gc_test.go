@@ -0,0 +1,158 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/gc"
+	"testing"
+	"time"
+)
+
+func TestGCBatches(t *testing.T) {
+	tv := newTestVolume(t, "gcMemoryM = 2")
+	const n = 1000
+
+	b := tv.open()
+	data := make(map[int64][]byte)
+	for i := int64(0); i < 6; i++ {
+		data[i*n] = tv.write(b, i*n, n)
+	}
+	for i := int64(0); i < 6; i++ {
+		copy(data[i*n], tv.write(b, i*n, 750))
+	}
+	tv.close(b)
+
+	b = tv.open()
+	purgeSet := map[int64]bool{}
+	for k := int64(0); k < 6; k++ {
+		purgeSet[k] = true
+	}
+	var batches int
+	cost := func(c gc.Candidate) int64 { return (c.Total + c.Used) * 512 }
+	err := b.runBatches(&purgeSet, cost, func(batch *map[int64]bool) error {
+		// Two victims do not fit into the memory left by the open object
+		if len(*batch) != 1 {
+			t.Errorf("batch of %v victims", len(*batch))
+		}
+		batches++
+		return b.gcRun2(batch)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batches != 6 {
+		t.Fatalf("%v batches, expected 6", batches)
+	}
+	tv.close(b)
+
+	objects := tv.objects()
+	for k := range purgeSet {
+		if _, ok := objects[k]; ok {
+			t.Fatalf("victim %v was not deleted", k)
+		}
+	}
+
+	b = tv.open()
+	defer tv.close(b)
+	for lba, d := range data {
+		tv.check(b, lba, n, d)
+	}
+}
+
+// Objects written with another object size or compressed are collected from
+// their live data, not assuming the current object size.
+func TestGCObjectsOfOtherSize(t *testing.T) {
+	for _, settings := range []string{"", `compression = "zstd"`} {
+		t.Run(settings, func(t *testing.T) {
+			tv := newTestVolume(t, "objectSizeM = 2\n"+settings)
+			const n = 1000
+
+			b := tv.open()
+			data := make(map[int64][]byte)
+			for i := int64(0); i < 4; i++ {
+				data[i*n] = tv.write(b, i*n, n)
+			}
+			tv.write(b, n, n)
+			data[n] = tv.write(b, n, n)
+			tv.close(b)
+
+			tv.configure("objectSizeM = 1\n" + settings)
+			for _, run := range []string{"gcRun", "gcRun2"} {
+				b = tv.open()
+				victims := map[int64]bool{0: true}
+				if run == "gcRun" {
+					victims = map[int64]bool{1: true}
+				}
+				var err error
+				if run == "gcRun" {
+					err = b.gcRun(&victims)
+				} else {
+					err = b.gcRun2(&victims)
+				}
+				if err != nil {
+					t.Fatal(run, err)
+				}
+				for lba, d := range data {
+					tv.check(b, lba, n, d)
+				}
+				tv.close(b)
+			}
+
+			objects := tv.objects()
+			if _, ok := objects[0]; ok {
+				t.Fatal("victim 0 was not deleted")
+			}
+			if _, ok := objects[1]; ok {
+				t.Fatal("victim 1 was not deleted")
+			}
+		})
+	}
+}
+
+// The writer is not held up by a GC run waiting for the throttle, and data
+// overwritten during the run are not reverted by it.
+func TestWritesDuringThrottledGC(t *testing.T) {
+	tv := newTestVolume(t, "gcBandwidthM = 0.5")
+	const n = 1000
+
+	b := tv.open()
+	data := make(map[int64][]byte)
+	for i := int64(0); i < 2; i++ {
+		data[i*n] = tv.write(b, i*n, n)
+	}
+	tv.close(b)
+
+	b = tv.open()
+	victims := map[int64]bool{0: true}
+	done := make(chan error)
+	go func() { done <- b.gcRun(&victims) }()
+	// The upload of the copy waits for the throttle for about two seconds
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	data[0] = append(tv.write(b, 0, n/2), data[0][n/2*512:]...)
+	b.flush()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("write took %v during the GC run", d)
+	}
+	select {
+	case <-done:
+		t.Fatal("GC run was not throttled")
+	default:
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	tv.check(b, 0, n, data[0])
+	tv.close(b)
+
+	b = tv.open()
+	defer tv.close(b)
+	if _, ok := tv.objects()[0]; ok {
+		t.Fatal("victim 0 was not deleted")
+	}
+	for lba, d := range data {
+		tv.check(b, lba, n, d)
+	}
+}
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/journal"
+	"fmt"
+	"sort"
+)
+
+const (
+	journalPrefix = "gc-"
+	journalFmt    = journalPrefix + "%08d"
+)
+
+// beginGC records the intent of a GC run collecting the objects, which writes
+// the objects with keys from first up to end. It has to be called with the GC
+// lock held, before any object with a later key can be uploaded.
+func (this *ObjectBackend) beginGC(purgeSet *map[int64]bool, first, end int64) (*journal.Record, error) {
+	r := &journal.Record{
+		Volume: this.volume,
+		First:  first,
+		End:    end,
+	}
+	for k := range *purgeSet {
+		r.Victims = append(r.Victims, k)
+	}
+	sort.Slice(r.Victims, func(i, j int) bool { return r.Victims[i] < r.Victims[j] })
+
+	if err := this.store.PutMeta(fmt.Sprintf(journalFmt, r.First), journal.Encode(r)); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// commitGC marks the run as done once all its objects are uploaded. It has to
+// succeed before the extent map points to the objects, as checkpoints written
+// afterwards refer to them, and before any victim is voided.
+func (this *ObjectBackend) commitGC(r *journal.Record) {
+	r.Committed = true
+	buf := journal.Encode(r)
+	retry("GC commit", func() error {
+		return this.store.PutMeta(fmt.Sprintf(journalFmt, r.First), buf)
+	})
+}
+
+// abortGC drops the record of a failed run once its objects are uploaded
+// empty, so the recovery skips them.
+func (this *ObjectBackend) abortGC(r *journal.Record) {
+	retry("GC journal deletion", func() error {
+		return this.store.DeleteMeta(fmt.Sprintf(journalFmt, r.First))
+	})
+}
+
+// endGC drops the record after the victims are voided. A failure is not fatal,
+// the recovery voids the victims again.
+func (this *ObjectBackend) endGC(r *journal.Record) {
+	if err := this.store.DeleteMeta(fmt.Sprintf(journalFmt, r.First)); err != nil {
+		fmt.Println("GC journal", r.First, "not deleted:", err)
+	}
+}
+
+// recoverGC finishes GC runs interrupted by a crash before the volume is
+// replayed. Committed runs are rolled forward by collecting the victims, the
+// objects of uncommitted ones are deleted, so the victims stay the only
+// copies of the data.
+func (this *ObjectBackend) recoverGC() {
+	names, err := this.store.ListMeta(journalPrefix)
+	if err != nil {
+		panic(err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf, err := this.store.GetMeta(name)
+		if err != nil {
+			panic(err)
+		}
+		r, err := journal.Decode(buf)
+		if err != nil {
+			panic(fmt.Sprintf("GC journal %v is unreadable: %v", name, err))
+		}
+		if !this.volume.IsZero() && this.volume != r.Volume {
+			panic(fmt.Sprintf("GC journal %v belongs to volume %v, expected %v", name, r.Volume, this.volume))
+		}
+		// The manifest written below has to name the volume
+		this.volume = r.Volume
+
+		if r.Committed {
+			if err := this.updateManifest(this.collected().With(r.Victims)); err != nil {
+				panic(err)
+			}
+			for _, key := range r.Victims {
+				if _, err := this.store.Head(key); err == nil {
+					this.deleteObject(key)
+				}
+			}
+			fmt.Println("GC run", r.First, "completed, collected", len(r.Victims), "objects")
+		} else {
+			var keys []int64
+			err := this.store.List(r.First-1, func(key, size int64) {
+				if key < r.End {
+					keys = append(keys, key)
+				}
+			})
+			if err != nil {
+				panic(err)
+			}
+			this.rollBack(r, keys)
+		}
+
+		if err := this.store.DeleteMeta(name); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// rollBack deletes the objects of an uncommitted run. Objects written after
+// the run are kept. Keys of the run are added to the manifest rather than
+// assigned again, as a replica may hold the objects already, and the deletions
+// are repeated on the replica.
+func (this *ObjectBackend) rollBack(r *journal.Record, keys []int64) {
+	if r.First == r.End {
+		fmt.Println("GC run", r.First, "rolled back, no objects written")
+		return
+	}
+
+	var run []int64
+	for k := r.First; k < r.End; k++ {
+		run = append(run, k)
+	}
+	m := this.collected().With(run)
+	if err := this.updateManifest(m); err != nil {
+		panic(err)
+	}
+	for _, key := range keys {
+		if err := this.store.Delete(key); err != nil {
+			panic(err)
+		}
+	}
+	this.replicateDeletion(m, keys)
+	fmt.Println("GC run", r.First, "rolled back, deleted", len(keys), "objects")
+}
@@ -0,0 +1,482 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package header
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// On-disk layout of an object header:
+//
+//	0   magic        [8]byte
+//	8   version      uint32
+//	12  crc          uint32 (CRC32C of the whole header with this field zeroed)
+//	16  volume       [16]byte
+//	32  seq          int64
+//	40  extents      int64
+//	48  objectSize   int64
+//	56  headerSize   int64
+//	64  entrySize    int64
+//	72  blockSize    int64
+//	80  dataSize     int64
+//	88  sumOffset    int64
+//	96  entryOffset  int64
+//	104 sumCRC       uint32 (CRC32C of the checksum table)
+//	112 logicalStart int64 (offset of the first extent in the object map)
+//	120 frames       int64
+//	128 frameOffset  int64
+//	136 frameCRC     uint32 (CRC32C of the frame table)
+//	140 cipher       uint32
+//	144 nonce        [24]byte
+//	168 indexSize    int64 (size of the entries and the frame table as stored)
+//	512 checksums    one CRC32C per blockSize bytes of data
+//	... entries      extents * entrySize bytes
+//	... frame table  frames * FrameSize bytes
+//
+// Every entry holds varint encoded LBA and length of one extent, each in its
+// own 8-byte slot. Data of the extents follow the header in the same order.
+// An entry with a negative length is a reference to data stored in another
+// object by the deduplication. It takes two entries, the second one holds
+// the key and the PBA of the data instead of LBA and length.
+//
+// Objects without frames store the data as they are and the extents start
+// right after the header. Compressed objects store the data in frames listed
+// in the frame table, each frame covering a range of sectors of a single
+// extent:
+//
+//	0   lsector  uint32 (first sector of the frame as addressed by the map)
+//	4   offset   uint32 (offset of the frame from the end of the header)
+//	8   length   uint32 (compressed length of the frame)
+//	12  sectors  uint16
+//	14  codec    uint8
+//
+// The checksums of compressed objects cover the compressed data.
+//
+// Encrypted objects are always stored in frames, every frame is sealed on its
+// own. The entries together with the frame table are sealed as a single piece
+// followed by the authentication tag, indexSize includes the tag. The fixed
+// part and the checksums stay in plaintext.
+const (
+	Version   = 1
+	FixedSize = 512
+	EntrySize = 16
+	FrameSize = 16
+	BlockSize = 4096
+
+	slotSize = 8
+	sumSize  = 4
+)
+
+var (
+	magic  = [8]byte{'D', 'I', 'S', 'O', 'B', 'J', 0, 0}
+	crcTab = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrMagic    = errors.New("header: bad magic")
+	ErrVersion  = errors.New("header: unsupported version")
+	ErrChecksum = errors.New("header: checksum mismatch")
+	ErrShort    = errors.New("header: truncated")
+)
+
+// Volume is a random UUID identifying objects belonging to the same volume.
+type Volume [16]byte
+
+type Header struct {
+	Version    uint32
+	Volume     Volume
+	Seq        int64
+	Extents    int64
+	ObjectSize int64
+	Size       int64
+	EntrySize  int64
+
+	BlockSize   int64
+	DataSize    int64
+	SumOffset   int64
+	EntryOffset int64
+	SumCRC      uint32
+
+	LogicalStart int64
+	Frames       int64
+	FrameOffset  int64
+	FrameCRC     uint32
+
+	Cipher    uint8
+	Nonce     [24]byte
+	IndexSize int64
+}
+
+// Frame is a compressed range of sectors of an object.
+type Frame struct {
+	LSector  int64
+	LSectors int64
+	Offset   int64
+	Len      int64
+	Codec    uint8
+}
+
+// Size returns the size of the header in bytes for objects of objectSize
+// bytes. The header has room for an extent per sector and a checksum per
+// block.
+func Size(objectSize int64) int64 {
+	return FixedSize + sumsRegion(objectSize) + roundUp(objectSize/512*EntrySize, 512)
+}
+
+func sumsRegion(objectSize int64) int64 {
+	return roundUp((objectSize+BlockSize-1)/BlockSize*sumSize, 512)
+}
+
+// FramedSize returns the size of the header of a compressed object.
+func FramedSize(extents, frames, dataSize int64) int64 {
+	return FixedSize + sumsRegion(dataSize) + roundUp(extents*EntrySize+frames*FrameSize, 512)
+}
+
+// LegacySize returns the size of the header of an object written before the
+// header was versioned, i.e. a bare array of (LBA, Len) pairs.
+func LegacySize(objectSize int64) int64 {
+	return objectSize / 512 * EntrySize
+}
+
+// Peek returns the size of the whole header given its first FixedSize bytes
+// and the size of the object. Objects without magic are considered legacy.
+func Peek(first []byte, objectSize int64) (size int64, legacy bool) {
+	if len(first) < FixedSize || !bytes.Equal(first[:len(magic)], magic[:]) {
+		return LegacySize(objectSize), true
+	}
+
+	return int64(binary.LittleEndian.Uint64(first[56:])), false
+}
+
+// PutEntry stores the i-th extent into the header buffer of an object of
+// objectSize bytes.
+func PutEntry(buf []byte, objectSize, i, lba, length int64) {
+	slice := buf[FixedSize+sumsRegion(objectSize)+i*EntrySize:]
+	binary.PutVarint(slice, lba)
+	binary.PutVarint(slice[slotSize:], length)
+}
+
+// PutRef stores a reference to length sectors at PBA of the object key as the
+// i-th and (i+1)-th entry.
+func PutRef(buf []byte, objectSize, i, lba, length, key, pba int64) {
+	PutEntry(buf, objectSize, i, lba, -length)
+	PutEntry(buf, objectSize, i+1, key, pba)
+}
+
+// GetEntry returns the i-th extent stored by PutEntry.
+func GetEntry(buf []byte, objectSize, i int64) (lba, length int64) {
+	slice := buf[FixedSize+sumsRegion(objectSize)+i*EntrySize:]
+	lba, _ = binary.Varint(slice[:slotSize])
+	length, _ = binary.Varint(slice[slotSize : 2*slotSize])
+
+	return lba, length
+}
+
+// Entries returns the first n entries stored by PutEntry.
+func Entries(buf []byte, objectSize, n int64) []byte {
+	from := FixedSize + sumsRegion(objectSize)
+	return buf[from : from+n*EntrySize]
+}
+
+// Sum returns the checksum of a single block.
+func Sum(block []byte) uint32 {
+	return crc32.Checksum(block, crcTab)
+}
+
+// Seal fills the fixed part and the checksum table of the header and computes
+// its checksum. The buffer has to contain the whole header followed by
+// h.DataSize bytes of data.
+func Seal(buf []byte, h *Header) {
+	h.SumOffset = FixedSize
+	h.EntryOffset = FixedSize + sumsRegion(h.ObjectSize)
+	h.LogicalStart = h.Size
+	seal(buf, h)
+}
+
+// SealFramed returns a compressed object consisting of a header with the
+// entries and the frames followed by the data of the frames. Size, DataSize
+// and the offsets of h are set accordingly, the caller sets LogicalStart.
+// If encrypt is not nil, it is used to seal the entries and the frame table,
+// the caller sets Cipher and Nonce.
+func SealFramed(h *Header, entries []byte, frames []Frame, data []byte, encrypt func(index []byte) []byte) []byte {
+	index := make([]byte, int64(len(entries))+int64(len(frames))*FrameSize)
+	copy(index, entries)
+	table := index[len(entries):]
+	for i, f := range frames {
+		slice := table[i*FrameSize:]
+		binary.LittleEndian.PutUint32(slice[0:], uint32(f.LSector))
+		binary.LittleEndian.PutUint32(slice[4:], uint32(f.Offset))
+		binary.LittleEndian.PutUint32(slice[8:], uint32(f.Len))
+		binary.LittleEndian.PutUint16(slice[12:], uint16(f.LSectors))
+		slice[14] = f.Codec
+	}
+	h.FrameCRC = crc32.Checksum(table, crcTab)
+	if encrypt != nil {
+		index = encrypt(index)
+	}
+
+	h.DataSize = int64(len(data))
+	h.Frames = int64(len(frames))
+	h.IndexSize = int64(len(index))
+	h.SumOffset = FixedSize
+	h.EntryOffset = FixedSize + sumsRegion(h.DataSize)
+	h.FrameOffset = h.EntryOffset + h.Extents*EntrySize
+	h.Size = h.EntryOffset + roundUp(h.IndexSize, 512)
+
+	buf := make([]byte, h.Size+h.DataSize)
+	copy(buf[h.EntryOffset:], index)
+	copy(buf[h.Size:], data)
+
+	seal(buf, h)
+
+	return buf
+}
+
+func seal(buf []byte, h *Header) {
+	h.Version = Version
+	h.EntrySize = EntrySize
+	h.BlockSize = BlockSize
+
+	data := buf[h.Size : h.Size+h.DataSize]
+	sums := buf[h.SumOffset:h.SumOffset:h.EntryOffset]
+	for i := int64(0); i < h.DataSize; i += h.BlockSize {
+		end := i + h.BlockSize
+		if end > h.DataSize {
+			end = h.DataSize
+		}
+		sums = sums[:len(sums)+sumSize]
+		binary.LittleEndian.PutUint32(sums[len(sums)-sumSize:], Sum(data[i:end]))
+	}
+	h.SumCRC = crc32.Checksum(sums, crcTab)
+
+	copy(buf, magic[:])
+	binary.LittleEndian.PutUint32(buf[8:], h.Version)
+	binary.LittleEndian.PutUint32(buf[12:], 0)
+	copy(buf[16:32], h.Volume[:])
+	binary.LittleEndian.PutUint64(buf[32:], uint64(h.Seq))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(h.Extents))
+	binary.LittleEndian.PutUint64(buf[48:], uint64(h.ObjectSize))
+	binary.LittleEndian.PutUint64(buf[56:], uint64(h.Size))
+	binary.LittleEndian.PutUint64(buf[64:], uint64(h.EntrySize))
+	binary.LittleEndian.PutUint64(buf[72:], uint64(h.BlockSize))
+	binary.LittleEndian.PutUint64(buf[80:], uint64(h.DataSize))
+	binary.LittleEndian.PutUint64(buf[88:], uint64(h.SumOffset))
+	binary.LittleEndian.PutUint64(buf[96:], uint64(h.EntryOffset))
+	binary.LittleEndian.PutUint32(buf[104:], h.SumCRC)
+	binary.LittleEndian.PutUint64(buf[112:], uint64(h.LogicalStart))
+	binary.LittleEndian.PutUint64(buf[120:], uint64(h.Frames))
+	binary.LittleEndian.PutUint64(buf[128:], uint64(h.FrameOffset))
+	binary.LittleEndian.PutUint32(buf[136:], h.FrameCRC)
+	binary.LittleEndian.PutUint32(buf[140:], uint32(h.Cipher))
+	copy(buf[144:168], h.Nonce[:])
+	binary.LittleEndian.PutUint64(buf[168:], uint64(h.IndexSize))
+
+	binary.LittleEndian.PutUint32(buf[12:], crc32.Checksum(buf[:h.Size], crcTab))
+}
+
+// ParseFixed decodes the fixed part of the header without verifying the
+// checksum, which covers the whole header. It is meant for reading just the
+// checksum table, which is verified on its own by Sums.
+func ParseFixed(buf []byte) (*Header, error) {
+	if len(buf) < FixedSize {
+		return nil, ErrShort
+	}
+	if !bytes.Equal(buf[:len(magic)], magic[:]) {
+		return nil, ErrMagic
+	}
+
+	h := new(Header)
+	h.Version = binary.LittleEndian.Uint32(buf[8:])
+	copy(h.Volume[:], buf[16:32])
+	h.Seq = int64(binary.LittleEndian.Uint64(buf[32:]))
+	h.Extents = int64(binary.LittleEndian.Uint64(buf[40:]))
+	h.ObjectSize = int64(binary.LittleEndian.Uint64(buf[48:]))
+	h.Size = int64(binary.LittleEndian.Uint64(buf[56:]))
+	h.EntrySize = int64(binary.LittleEndian.Uint64(buf[64:]))
+	h.BlockSize = int64(binary.LittleEndian.Uint64(buf[72:]))
+	h.DataSize = int64(binary.LittleEndian.Uint64(buf[80:]))
+	h.SumOffset = int64(binary.LittleEndian.Uint64(buf[88:]))
+	h.EntryOffset = int64(binary.LittleEndian.Uint64(buf[96:]))
+	h.SumCRC = binary.LittleEndian.Uint32(buf[104:])
+	h.LogicalStart = int64(binary.LittleEndian.Uint64(buf[112:]))
+	h.Frames = int64(binary.LittleEndian.Uint64(buf[120:]))
+	h.FrameOffset = int64(binary.LittleEndian.Uint64(buf[128:]))
+	h.FrameCRC = binary.LittleEndian.Uint32(buf[136:])
+	h.Cipher = uint8(binary.LittleEndian.Uint32(buf[140:]))
+	copy(h.Nonce[:], buf[144:168])
+	h.IndexSize = int64(binary.LittleEndian.Uint64(buf[168:]))
+
+	if h.Version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, h.Version)
+	}
+	if h.BlockSize <= 0 || h.SumOffset+h.SumsSize() > h.EntryOffset {
+		return nil, ErrShort
+	}
+	if h.LogicalStart < 0 || h.Frames < 0 || h.FrameOffset+h.Frames*FrameSize > h.Size {
+		return nil, ErrShort
+	}
+	if h.IndexSize < 0 || h.EntryOffset+h.IndexSize > h.Size {
+		return nil, ErrShort
+	}
+
+	if h.Size < FixedSize || h.EntryOffset+h.Extents*h.EntrySize > h.Size {
+		return nil, ErrShort
+	}
+
+	return h, nil
+}
+
+// Parse validates the header in buf and returns its fixed part.
+func Parse(buf []byte) (*Header, error) {
+	h, err := ParseFixed(buf)
+	if err != nil {
+		return nil, err
+	}
+	if h.Size > int64(len(buf)) {
+		return nil, ErrShort
+	}
+
+	crc := binary.LittleEndian.Uint32(buf[12:])
+	binary.LittleEndian.PutUint32(buf[12:], 0)
+	sum := crc32.Checksum(buf[:h.Size], crcTab)
+	binary.LittleEndian.PutUint32(buf[12:], crc)
+	if crc != sum {
+		return nil, ErrChecksum
+	}
+
+	return h, nil
+}
+
+// SumsSize returns the size of the checksum table in bytes.
+func (this *Header) SumsSize() int64 {
+	return (this.DataSize + this.BlockSize - 1) / this.BlockSize * sumSize
+}
+
+// Sums decodes the checksum table, buf has to start at h.SumOffset.
+func (this *Header) Sums(buf []byte) ([]uint32, error) {
+	size := this.SumsSize()
+	if int64(len(buf)) < size {
+		return nil, ErrShort
+	}
+	if crc32.Checksum(buf[:size], crcTab) != this.SumCRC {
+		return nil, ErrChecksum
+	}
+
+	sums := make([]uint32, size/sumSize)
+	for i := range sums {
+		sums[i] = binary.LittleEndian.Uint32(buf[i*sumSize:])
+	}
+
+	return sums, nil
+}
+
+// Index returns the entries together with the frame table as stored in buf,
+// which has to contain the whole header.
+func (this *Header) Index(buf []byte) []byte {
+	return buf[this.EntryOffset : this.EntryOffset+this.IndexSize]
+}
+
+// AAD returns data every sealed piece of the object is bound to.
+func (this *Header) AAD() []byte {
+	aad := make([]byte, len(this.Volume)+8)
+	copy(aad, this.Volume[:])
+	binary.LittleEndian.PutUint64(aad[len(this.Volume):], uint64(this.Seq))
+
+	return aad
+}
+
+// FrameTable decodes the frame table, buf has to start at h.FrameOffset. It
+// returns nil for objects without frames.
+func (this *Header) FrameTable(buf []byte) ([]Frame, error) {
+	if this.Frames == 0 {
+		return nil, nil
+	}
+	size := this.Frames * FrameSize
+	if int64(len(buf)) < size {
+		return nil, ErrShort
+	}
+	if crc32.Checksum(buf[:size], crcTab) != this.FrameCRC {
+		return nil, ErrChecksum
+	}
+
+	frames := make([]Frame, this.Frames)
+	for i := range frames {
+		slice := buf[int64(i)*FrameSize:]
+		f := &frames[i]
+		f.LSector = int64(binary.LittleEndian.Uint32(slice[0:]))
+		f.Offset = int64(binary.LittleEndian.Uint32(slice[4:]))
+		f.Len = int64(binary.LittleEndian.Uint32(slice[8:]))
+		f.LSectors = int64(binary.LittleEndian.Uint16(slice[12:]))
+		f.Codec = slice[14]
+		if f.Offset+f.Len > this.DataSize {
+			return nil, ErrShort
+		}
+	}
+
+	return frames, nil
+}
+
+// Entry returns the i-th extent stored in the header. A negative length marks
+// a reference, the (i+1)-th entry then holds its key and PBA.
+func (this *Header) Entry(buf []byte, i int64) (lba, length int64) {
+	slice := buf[this.EntryOffset+i*this.EntrySize:]
+	lba, _ = binary.Varint(slice[:slotSize])
+	length, _ = binary.Varint(slice[slotSize : 2*slotSize])
+
+	return lba, length
+}
+
+// LegacyEntries calls fn for every extent of a legacy header.
+func LegacyEntries(buf []byte, fn func(lba, length int64)) {
+	for i := 0; i+EntrySize <= len(buf); i += EntrySize {
+		lba, _ := binary.Varint(buf[i : i+slotSize])
+		length, _ := binary.Varint(buf[i+slotSize : i+2*slotSize])
+		if length == 0 {
+			break
+		}
+		fn(lba, length)
+	}
+}
+
+func NewVolume() Volume {
+	var v Volume
+	if _, err := rand.Read(v[:]); err != nil {
+		panic(err)
+	}
+	v[6] = v[6]&0x0f | 0x40
+	v[8] = v[8]&0x3f | 0x80
+
+	return v
+}
+
+func ParseVolume(s string) (Volume, error) {
+	var v Volume
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return v, err
+	}
+	if len(b) != len(v) {
+		return v, fmt.Errorf("header: volume %q is not a UUID", s)
+	}
+	copy(v[:], b)
+
+	return v, nil
+}
+
+func (this Volume) IsZero() bool {
+	return this == Volume{}
+}
+
+func (this Volume) String() string {
+	h := hex.EncodeToString(this[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func roundDown(x, y int64) int64 { return x - x%y }
+func roundUp(x, y int64) int64   { return roundDown(x+y-1, y) }
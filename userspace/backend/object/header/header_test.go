@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package header
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+const testObjectSize = 64 * 1024
+
+// sealed returns an object with two extents and a reference, followed by
+// 9 KiB of random data, so the last checksum covers a partial block.
+func sealed() ([]byte, *Header) {
+	size := Size(testObjectSize)
+	data := int64(9 * 1024)
+	buf := make([]byte, size+data)
+	rand.Read(buf[size:])
+
+	PutEntry(buf, testObjectSize, 0, 100, 8)
+	PutRef(buf, testObjectSize, 1, 200, 4, 7, 16)
+	PutEntry(buf, testObjectSize, 3, 300, 10)
+	h := &Header{
+		Volume:     NewVolume(),
+		Seq:        42,
+		Extents:    4,
+		ObjectSize: testObjectSize,
+		Size:       size,
+		DataSize:   data,
+	}
+	Seal(buf, h)
+
+	return buf, h
+}
+
+func TestSealParse(t *testing.T) {
+	buf, sealedHeader := sealed()
+
+	if size, legacy := Peek(buf[:FixedSize], int64(len(buf))); legacy || size != sealedHeader.Size {
+		t.Fatalf("Peek returned %v, %v", size, legacy)
+	}
+	h, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(h, sealedHeader) {
+		t.Fatalf("parsed %+v, sealed %+v", h, sealedHeader)
+	}
+
+	want := [][2]int64{{100, 8}, {200, -4}, {7, 16}, {300, 10}}
+	for i, w := range want {
+		if lba, length := h.Entry(buf, int64(i)); lba != w[0] || length != w[1] {
+			t.Errorf("entry %v is %v, %v, want %v", i, lba, length, w)
+		}
+	}
+
+	sums, err := h.Sums(buf[h.SumOffset:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf[h.Size:]
+	if len(sums) != 3 {
+		t.Fatalf("%v checksums, want 3", len(sums))
+	}
+	for i, sum := range sums {
+		end := (i + 1) * BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if sum != Sum(data[i*BlockSize:end]) {
+			t.Errorf("checksum of block %v differs", i)
+		}
+	}
+}
+
+func TestSealFramed(t *testing.T) {
+	entries := make([]byte, 2*EntrySize)
+	frames := []Frame{
+		{LSector: 0, LSectors: 8, Offset: 0, Len: 1000, Codec: 1},
+		{LSector: 8, LSectors: 2, Offset: 1000, Len: 1024, Codec: 0},
+	}
+	data := make([]byte, 2024)
+	rand.Read(data)
+
+	h := &Header{Volume: NewVolume(), Seq: 3, Extents: 2, ObjectSize: testObjectSize}
+	buf := SealFramed(h, entries, frames, data, nil)
+
+	parsed, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parsed.FrameTable(buf[parsed.FrameOffset:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, frames) {
+		t.Fatalf("frames %+v, want %+v", got, frames)
+	}
+
+	buf[parsed.FrameOffset] ^= 1
+	if _, err := parsed.FrameTable(buf[parsed.FrameOffset:]); !errors.Is(err, ErrChecksum) {
+		t.Fatal("corrupted frame table accepted:", err)
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(buf []byte) []byte
+		want    error
+	}{
+		{"magic", func(buf []byte) []byte { buf[0] = 'X'; return buf }, ErrMagic},
+		{"version", func(buf []byte) []byte { buf[8] = 99; return buf }, ErrVersion},
+		{"seq", func(buf []byte) []byte { buf[32] ^= 1; return buf }, ErrChecksum},
+		{"entry", func(buf []byte) []byte { buf[FixedSize+sumsRegion(testObjectSize)] ^= 1; return buf }, ErrChecksum},
+		{"fixed part truncated", func(buf []byte) []byte { return buf[:FixedSize-1] }, ErrShort},
+		{"header truncated", func(buf []byte) []byte { return buf[:FixedSize] }, ErrShort},
+	}
+
+	for _, test := range tests {
+		buf, _ := sealed()
+		if _, err := Parse(test.corrupt(buf)); !errors.Is(err, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	buf, h := sealed()
+	buf[h.SumOffset] ^= 1
+	if _, err := h.Sums(buf[h.SumOffset:]); !errors.Is(err, ErrChecksum) {
+		t.Error("corrupted checksum table accepted:", err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	buf := make([]byte, FixedSize)
+	if size, legacy := Peek(buf, testObjectSize); !legacy || size != LegacySize(testObjectSize) {
+		t.Fatalf("Peek returned %v, %v", size, legacy)
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	v := NewVolume()
+	parsed, err := ParseVolume(v.String())
+	if err != nil || parsed != v {
+		t.Fatalf("parsed %v, %v, want %v", parsed, err, v)
+	}
+	if _, err := ParseVolume("not a volume"); err == nil {
+		t.Fatal("invalid volume accepted")
+	}
+}
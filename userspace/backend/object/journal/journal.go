@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package journal
+
+import (
+	"bytes"
+	"dis/backend/object/header"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Layout of a serialized record:
+//
+//	0   magic        [8]byte
+//	8   version      uint32
+//	12  crc          uint32 (CRC32C of the whole record with this field zeroed)
+//	16  volume       [16]byte
+//	32  first        int64 (first key written by the GC run)
+//	40  end          int64 (first key after the run)
+//	48  committed    uint64
+//	56  victims      int64
+//	64  victims      int64 keys
+const (
+	Version = 1
+
+	fixedSize = 64
+)
+
+var (
+	magic = [8]byte{'D', 'I', 'S', 'G', 'C', 'J', 'N', 'L'}
+
+	ErrMagic    = errors.New("journal: bad magic")
+	ErrVersion  = errors.New("journal: unsupported version")
+	ErrChecksum = errors.New("journal: checksum mismatch")
+	ErrShort    = errors.New("journal: truncated")
+)
+
+// Record describes a single GC run. Objects with keys from First up to End
+// are written by the run, the victims are deleted only after the record is committed, when
+// all the objects are uploaded.
+type Record struct {
+	Volume    header.Volume
+	First     int64
+	End       int64
+	Committed bool
+	Victims   []int64
+}
+
+func Encode(r *Record) []byte {
+	buf := make([]byte, fixedSize+len(r.Victims)*8)
+
+	copy(buf, magic[:])
+	binary.LittleEndian.PutUint32(buf[8:], Version)
+	copy(buf[16:32], r.Volume[:])
+	binary.LittleEndian.PutUint64(buf[32:], uint64(r.First))
+	binary.LittleEndian.PutUint64(buf[40:], uint64(r.End))
+	if r.Committed {
+		binary.LittleEndian.PutUint64(buf[48:], 1)
+	}
+	binary.LittleEndian.PutUint64(buf[56:], uint64(len(r.Victims)))
+
+	off := fixedSize
+	for _, k := range r.Victims {
+		binary.LittleEndian.PutUint64(buf[off:], uint64(k))
+		off += 8
+	}
+
+	binary.LittleEndian.PutUint32(buf[12:], header.Sum(buf))
+
+	return buf
+}
+
+func Decode(buf []byte) (*Record, error) {
+	if len(buf) < fixedSize {
+		return nil, ErrShort
+	}
+	if !bytes.Equal(buf[:len(magic)], magic[:]) {
+		return nil, ErrMagic
+	}
+	if version := binary.LittleEndian.Uint32(buf[8:]); version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, version)
+	}
+
+	victims := int64(binary.LittleEndian.Uint64(buf[56:]))
+	if victims < 0 || int64(len(buf)) != fixedSize+victims*8 {
+		return nil, ErrShort
+	}
+
+	crc := binary.LittleEndian.Uint32(buf[12:])
+	binary.LittleEndian.PutUint32(buf[12:], 0)
+	sum := header.Sum(buf)
+	binary.LittleEndian.PutUint32(buf[12:], crc)
+	if crc != sum {
+		return nil, ErrChecksum
+	}
+
+	r := &Record{
+		First:     int64(binary.LittleEndian.Uint64(buf[32:])),
+		End:       int64(binary.LittleEndian.Uint64(buf[40:])),
+		Committed: binary.LittleEndian.Uint64(buf[48:]) != 0,
+		Victims:   make([]int64, victims),
+	}
+	copy(r.Volume[:], buf[16:32])
+
+	off := fixedSize
+	for i := range r.Victims {
+		r.Victims[i] = int64(binary.LittleEndian.Uint64(buf[off:]))
+		off += 8
+	}
+
+	return r, nil
+}
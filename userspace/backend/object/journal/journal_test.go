@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package journal
+
+import (
+	"dis/backend/object/header"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	records := []*Record{
+		{Volume: header.NewVolume(), First: 20, Victims: []int64{3, 5, 8}},
+		{Volume: header.NewVolume(), First: 20, End: 23, Committed: true, Victims: []int64{3, 5, 8}},
+		{First: 1, End: 1, Committed: true, Victims: []int64{}},
+	}
+
+	for _, r := range records {
+		got, err := Decode(Encode(r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, r) {
+			t.Errorf("decoded %+v, encoded %+v", got, r)
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(buf []byte) []byte
+		want    error
+	}{
+		{"magic", func(buf []byte) []byte { buf[0] = 'X'; return buf }, ErrMagic},
+		{"version", func(buf []byte) []byte { buf[8] = 99; return buf }, ErrVersion},
+		{"committed", func(buf []byte) []byte { buf[48] ^= 1; return buf }, ErrChecksum},
+		{"victim", func(buf []byte) []byte { buf[len(buf)-8] ^= 1; return buf }, ErrChecksum},
+		{"truncated", func(buf []byte) []byte { return buf[:len(buf)-8] }, ErrShort},
+		{"fixed part truncated", func(buf []byte) []byte { return buf[:fixedSize-1] }, ErrShort},
+		{"negative count", func(buf []byte) []byte { buf[63] = 0x80; return buf }, ErrShort},
+	}
+
+	for _, test := range tests {
+		buf := Encode(&Record{Volume: header.NewVolume(), First: 20, Victims: []int64{3, 5}})
+		if _, err := Decode(test.corrupt(buf)); !errors.Is(err, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package manifest
+
+import (
+	"bytes"
+	"dis/backend/object/header"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Layout of a serialized manifest:
+//
+//	0   magic        [8]byte
+//	8   version      uint32
+//	12  crc          uint32 (CRC32C of the whole manifest with this field zeroed)
+//	16  volume       [16]byte
+//	32  ranges       int64
+//	40  ranges       (from, to) int64 pairs
+const (
+	Version = 1
+
+	fixedSize = 40
+	rangeSize = 2 * 8
+)
+
+var (
+	magic = [8]byte{'D', 'I', 'S', 'M', 'N', 'F', 'S', 'T'}
+
+	ErrMagic    = errors.New("manifest: bad magic")
+	ErrVersion  = errors.New("manifest: unsupported version")
+	ErrChecksum = errors.New("manifest: checksum mismatch")
+	ErrShort    = errors.New("manifest: truncated")
+)
+
+// Range holds keys from From up to To, which is not included.
+type Range struct {
+	From int64
+	To   int64
+}
+
+// Manifest is the set of keys of objects collected by the GC, which are absent
+// from the object store on purpose. Keys are kept as sorted disjoint ranges,
+// as neighboring objects tend to be collected eventually.
+type Manifest struct {
+	Volume header.Volume
+	Ranges []Range
+}
+
+// With returns a copy of the manifest with the keys added.
+func (this *Manifest) With(keys []int64) *Manifest {
+	ranges := append([]Range(nil), this.Ranges...)
+	for _, k := range keys {
+		ranges = append(ranges, Range{k, k + 1})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+
+	m := &Manifest{Volume: this.Volume}
+	for _, r := range ranges {
+		if n := len(m.Ranges); n > 0 && r.From <= m.Ranges[n-1].To {
+			if r.To > m.Ranges[n-1].To {
+				m.Ranges[n-1].To = r.To
+			}
+			continue
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+
+	return m
+}
+
+// Filled returns a copy of the manifest with all keys from from up to the last
+// collected key added.
+func (this *Manifest) Filled(from int64) *Manifest {
+	n := len(this.Ranges)
+	if n == 0 || this.Ranges[n-1].To <= from {
+		return this.With(nil)
+	}
+
+	var keys []int64
+	for k := this.Next(from); k < this.Ranges[n-1].To; k = this.Next(k + 1) {
+		keys = append(keys, k)
+	}
+
+	return this.With(keys)
+}
+
+// Contains returns true if the object of the key was collected.
+func (this *Manifest) Contains(key int64) bool {
+	i := sort.Search(len(this.Ranges), func(i int) bool {
+		return this.Ranges[i].To > key
+	})
+
+	return i < len(this.Ranges) && this.Ranges[i].From <= key
+}
+
+// Next returns the first key from key on which was not collected.
+func (this *Manifest) Next(key int64) int64 {
+	i := sort.Search(len(this.Ranges), func(i int) bool {
+		return this.Ranges[i].To > key
+	})
+	if i < len(this.Ranges) && this.Ranges[i].From <= key {
+		return this.Ranges[i].To
+	}
+
+	return key
+}
+
+func Encode(m *Manifest) []byte {
+	buf := make([]byte, fixedSize+len(m.Ranges)*rangeSize)
+
+	copy(buf, magic[:])
+	binary.LittleEndian.PutUint32(buf[8:], Version)
+	copy(buf[16:32], m.Volume[:])
+	binary.LittleEndian.PutUint64(buf[32:], uint64(len(m.Ranges)))
+
+	off := fixedSize
+	for _, r := range m.Ranges {
+		binary.LittleEndian.PutUint64(buf[off:], uint64(r.From))
+		binary.LittleEndian.PutUint64(buf[off+8:], uint64(r.To))
+		off += rangeSize
+	}
+
+	binary.LittleEndian.PutUint32(buf[12:], header.Sum(buf))
+
+	return buf
+}
+
+func Decode(buf []byte) (*Manifest, error) {
+	if len(buf) < fixedSize {
+		return nil, ErrShort
+	}
+	if !bytes.Equal(buf[:len(magic)], magic[:]) {
+		return nil, ErrMagic
+	}
+	if version := binary.LittleEndian.Uint32(buf[8:]); version != Version {
+		return nil, fmt.Errorf("%w: %d", ErrVersion, version)
+	}
+
+	ranges := int64(binary.LittleEndian.Uint64(buf[32:]))
+	if ranges < 0 || int64(len(buf)) != fixedSize+ranges*rangeSize {
+		return nil, ErrShort
+	}
+
+	crc := binary.LittleEndian.Uint32(buf[12:])
+	binary.LittleEndian.PutUint32(buf[12:], 0)
+	sum := header.Sum(buf)
+	binary.LittleEndian.PutUint32(buf[12:], crc)
+	if crc != sum {
+		return nil, ErrChecksum
+	}
+
+	m := &Manifest{Ranges: make([]Range, ranges)}
+	copy(m.Volume[:], buf[16:32])
+
+	off := fixedSize
+	for i := range m.Ranges {
+		m.Ranges[i].From = int64(binary.LittleEndian.Uint64(buf[off:]))
+		m.Ranges[i].To = int64(binary.LittleEndian.Uint64(buf[off+8:]))
+		off += rangeSize
+	}
+
+	return m, nil
+}
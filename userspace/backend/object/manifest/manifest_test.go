@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package manifest
+
+import (
+	"dis/backend/object/header"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestWith(t *testing.T) {
+	m := (&Manifest{}).With([]int64{5, 3, 4, 9, 4})
+	want := []Range{{3, 6}, {9, 10}}
+	if !reflect.DeepEqual(m.Ranges, want) {
+		t.Fatalf("ranges %v, want %v", m.Ranges, want)
+	}
+
+	m = m.With([]int64{6, 8})
+	want = []Range{{3, 7}, {8, 10}}
+	if !reflect.DeepEqual(m.Ranges, want) {
+		t.Fatalf("ranges %v, want %v", m.Ranges, want)
+	}
+	if m = m.With([]int64{7}); !reflect.DeepEqual(m.Ranges, []Range{{3, 10}}) {
+		t.Fatalf("ranges %v are not merged", m.Ranges)
+	}
+}
+
+func TestFilled(t *testing.T) {
+	m := &Manifest{Ranges: []Range{{3, 7}, {8, 10}, {12, 13}}}
+	tests := []struct {
+		from int64
+		want []Range
+	}{
+		{20, []Range{{3, 7}, {8, 10}, {12, 13}}},
+		{13, []Range{{3, 7}, {8, 10}, {12, 13}}},
+		{11, []Range{{3, 7}, {8, 10}, {11, 13}}},
+		{9, []Range{{3, 7}, {8, 13}}},
+		{0, []Range{{0, 13}}},
+	}
+
+	for _, test := range tests {
+		if got := m.Filled(test.from).Ranges; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("filled from %v: %v, want %v", test.from, got, test.want)
+		}
+	}
+	if len(m.Ranges) != 3 {
+		t.Error("original manifest modified")
+	}
+}
+
+func TestContainsNext(t *testing.T) {
+	m := &Manifest{Ranges: []Range{{3, 7}, {8, 10}}}
+	tests := []struct {
+		key      int64
+		contains bool
+		next     int64
+	}{
+		{0, false, 0},
+		{2, false, 2},
+		{3, true, 7},
+		{6, true, 7},
+		{7, false, 7},
+		{8, true, 10},
+		{10, false, 10},
+	}
+
+	for _, test := range tests {
+		if got := m.Contains(test.key); got != test.contains {
+			t.Errorf("Contains(%v) = %v", test.key, got)
+		}
+		if got := m.Next(test.key); got != test.next {
+			t.Errorf("Next(%v) = %v, want %v", test.key, got, test.next)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	manifests := []*Manifest{
+		{Volume: header.NewVolume(), Ranges: []Range{{3, 7}, {8, 10}}},
+		{Ranges: []Range{}},
+	}
+
+	for _, m := range manifests {
+		got, err := Decode(Encode(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("decoded %+v, encoded %+v", got, m)
+		}
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(buf []byte) []byte
+		want    error
+	}{
+		{"magic", func(buf []byte) []byte { buf[0] = 'X'; return buf }, ErrMagic},
+		{"version", func(buf []byte) []byte { buf[8] = 99; return buf }, ErrVersion},
+		{"volume", func(buf []byte) []byte { buf[16] ^= 1; return buf }, ErrChecksum},
+		{"range", func(buf []byte) []byte { buf[len(buf)-1] ^= 1; return buf }, ErrChecksum},
+		{"truncated", func(buf []byte) []byte { return buf[:len(buf)-1] }, ErrShort},
+		{"fixed part truncated", func(buf []byte) []byte { return buf[:fixedSize-1] }, ErrShort},
+		{"negative count", func(buf []byte) []byte { buf[39] = 0x80; return buf }, ErrShort},
+	}
+
+	for _, test := range tests {
+		buf := Encode(&Manifest{Volume: header.NewVolume(), Ranges: []Range{{3, 7}}})
+		if _, err := Decode(test.corrupt(buf)); !errors.Is(err, test.want) {
+			t.Errorf("%v: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend"
+	"dis/backend/object/extmap"
+	"dis/parser"
+	"fmt"
+	"sync"
+)
+
+// Migrate copies the volume configured by from to the object store configured
+// by to. Only the data mapped by the extent map are copied, repacked into
+// objects of the size configured by to, so the garbage of the volume is left
+// behind. Snapshots are not copied. Neither of the volumes may be served
+// meanwhile.
+func Migrate(from, to *parser.Config) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	src, err := openOffline("source", from, "recover", "")
+	if err != nil {
+		return fmt.Errorf("source: %w", err)
+	}
+	if names, err := src.store.ListMeta(snapshotPrefix); err == nil && len(names) > 0 {
+		fmt.Println("Snapshots of the source are not migrated:", len(names))
+	}
+
+	var id string
+	if !src.volume.IsZero() {
+		id = src.volume.String()
+	}
+	dst, err := openOffline("target", to, "fail-if-exists", id)
+	if err != nil {
+		return fmt.Errorf("target: %w", err)
+	}
+
+	var blocks int64
+	o := dst.nextObject(false)
+	var reads sync.WaitGroup
+	var failed failure
+	workers := make(chan struct{}, downloadWorkers)
+
+	upload := func() error {
+		if o.extents == 0 {
+			return nil
+		}
+		reads.Wait()
+		if err := failed.get(); err != nil {
+			return err
+		}
+
+		o.assignKey()
+		dst.em.Update(o.writelist)
+		*o.buf = (*o.buf)[:cap(*o.buf)]
+		o.seal()
+		if err := dst.store.Put(o.key, *o.buf); err != nil {
+			return fmt.Errorf("object %v: %w", o.key, err)
+		}
+		o = dst.nextObject(false)
+
+		return nil
+	}
+
+	for _, e := range src.em.Extents() {
+		for e.Len > 0 {
+			n := dst.objectSize/512 - o.blocks
+			if n <= 0 || (n < e.Len && o.extents != 0) {
+				if err := upload(); err != nil {
+					return err
+				}
+				n = dst.objectSize/512 - o.blocks
+			}
+			if n > e.Len {
+				n = e.Len
+			}
+
+			part := e
+			part.Len = n
+			slice := o.add(e.LBA, n, false)
+			reads.Add(1)
+			workers <- struct{}{}
+			go func(part extmap.Extent) {
+				failed.set(src.partDownload(&part, &slice))
+				<-workers
+				reads.Done()
+			}(part)
+
+			blocks += n
+			e.LBA += n
+			e.PBA += n
+			e.Len -= n
+		}
+	}
+	if err := upload(); err != nil {
+		return err
+	}
+
+	if _, err := dst.writeCheckpoint(); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %v blocks from %v objects into %v objects\n", blocks, src.seqNumber, dst.seqNumber)
+
+	return nil
+}
+
+// openOffline opens the volume configured by cfg in the startup mode without
+// serving it. The volume identification is overridden by id if it is given.
+func openOffline(name string, cfg *parser.Config, startup, id string) (*ObjectBackend, error) {
+	v := cfg.Sub(configSection)
+	v.Set("startup", startup)
+	if id != "" {
+		v.Set("volume", id)
+	}
+
+	this, err := open(v, &backend.Volume{Name: name, Config: cfg})
+	if err != nil {
+		return nil, err
+	}
+	// Migration does not replicate
+	this.replica = nil
+
+	return this, nil
+}
@@ -4,137 +4,421 @@
 package object
 
 import (
+	"dis/backend"
+	"dis/backend/object/api"
+	"dis/backend/object/api/dir"
+	"dis/backend/object/api/faults"
+	"dis/backend/object/api/memory"
+	"dis/backend/object/api/mirror"
 	"dis/backend/object/api/rados"
 	"dis/backend/object/api/s3"
+	"dis/backend/object/codec"
+	"dis/backend/object/crypt"
 	"dis/backend/object/extmap"
 	"dis/backend/object/gc"
+	"dis/backend/object/header"
+	"dis/backend/object/manifest"
+	"dis/backend/object/throttle"
+	"dis/cache"
+	"dis/control"
 	"dis/extent"
 	"dis/parser"
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"sync/atomic"
+	"github.com/hashicorp/golang-lru"
+	"github.com/spf13/viper"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	configSection = "backend.object"
 	envPrefix     = "dis_backend_object"
-)
 
-var (
-	bucket      string
-	region      string
-	remote      string
-	em          *extmap.ExtentMap
-	workloads   chan *[]extent.Extent
-	seqNumber   int64
-	api         string
-	gcMode      string
-	gcVersion   int64
-	objectSizeM int64
-	objectSize  int64
-	uploadF     func(key int64, buf *[]byte)
-	downloadF   func(key int64, buf *[]byte, from, to int64)
+	mirrorSection   = "backend.object.mirror"
+	mirrorEnvPrefix = "dis_backend_object_mirror"
 )
 
-type ObjectBackend struct{}
+// ObjectBackend stores a single volume as a log of objects.
+type ObjectBackend struct {
+	name         string
+	cache        *cache.Cache
+	gc           *gc.Collector
+	em           *extmap.ExtentMap
+	store        api.ObjectStore
+	volume       header.Volume
+	workloads    chan *[]extent.Extent
+	flushes      chan chan struct{}
+	seqNumber    int64
+	gcMode       string
+	gcPolicy     gc.Policy
+	gcThrottle   *throttle.Throttle
+	gcMemory     int64
+	objectSize   int64
+	headerBlocks int64
 
-func (this *ObjectBackend) Init() {
-	v := parser.Sub(configSection)
-	v.SetEnvPrefix(envPrefix)
+	checkpointObjects int64
+	checkpointMinutes int64
+	startup           string
 
-	v.BindEnv("api")
-	v.BindEnv("gcMode")
-	v.BindEnv("gcVersion")
-	v.BindEnv("objectSizeM")
-	api = v.GetString("api")
-	gcMode = v.GetString("gcMode")
-	gcVersion = v.GetInt64("gcVersion")
-	objectSizeM = v.GetInt64("objectSizeM")
-	objectSize = objectSizeM * 1024 * 1024
-
-	if gcMode != "on" && gcMode != "statsOnly" && gcMode != "off" && gcMode != "silent" && objectSize == 0 {
-		panic("")
-	}
-
-	em = extmap.New()
-
-	if api == "s3" {
-		uploadF = s3.Upload
-		downloadF = s3.Download
-		s3.FnHeaderToMap = func(header *[]byte, key, size int64) {
-			atomic.StoreInt64(&seqNumber, key+1)
-			const int64Size = 8
-			var blocks int64 = (writelistLen * 16) / 512
-
-			gc.Create(key, size/512)
-			for i := 0; i < len(*header); i += 2 * int64Size {
-				var e extmap.Extent
-				e.Key = key
-				e.PBA = blocks
-				e.LBA, _ = binary.Varint((*header)[i : i+int64Size])
-				e.Len, _ = binary.Varint((*header)[i+int64Size : i+2*int64Size])
-				if e.Len == 0 {
-					break
-				}
-				em.UpdateSingle(&e)
-				blocks += e.Len
-			}
+	mutex        sync.RWMutex
+	uploading    map[int64]bool
+	writelistLen int64
+
+	cacheWriteChan chan cacheWriteJob
+	downloadChan   chan downloadJob
+
+	infoCache    *lru.Cache
+	compression  uint8
+	sealer       *crypt.Cipher
+	dedup        bool
+	fingerprints *lru.Cache
+
+	// Keys of the objects deleted by the GC
+	manifestMutex sync.Mutex
+	manifest      *manifest.Manifest
+
+	snapshotMutex sync.Mutex
+	snapshots     map[string]*snapshot
+
+	// Second copy of the objects if they are mirrored, nil otherwise
+	secondary api.ObjectStore
+
+	// Asynchronous copy of the volume, nil if it is not replicated
+	replica *replica
+
+	// Store of the parent of a clone, it is only read
+	parent         api.ObjectStore
+	parentSnapshot string
+	parentSeq      int64
+	// Set if the extent map refers to objects of the parent
+	clone bool
+
+	// done is closed by Close, goroutines of the backend exit then
+	done    chan struct{}
+	workers sync.WaitGroup
+	readers sync.WaitGroup
+}
+
+func init() {
+	backend.Register("object", New)
+}
+
+func New(v *viper.Viper, vol *backend.Volume) (backend.Backend, error) {
+	this, err := open(v, vol)
+	if err != nil {
+		return nil, err
+	}
+
+	this.loadSnapshots()
+	control.Handle(this.name, "/snapshots", this.snapshotHandler)
+
+	if this.replica != nil {
+		if err := this.startReplica(); err != nil {
+			control.Unhandle(this.name, "/snapshots")
+			return nil, fmt.Errorf("replica: %w", err)
 		}
-		s3.Init()
-	} else if api == "rados" {
-		uploadF = rados.Upload
-		downloadF = rados.Download
-		rados.Init()
-	} else {
-		panic("")
+		control.Handle(this.name, "/replication", this.replicationHandler)
 	}
 
-	workloads = make(chan *[]extent.Extent)
-	go writer()
+	this.workers.Add(5)
+	go this.writer()
+	go this.checkpointer()
 
+	this.readers.Add(cacheWriteWorkers)
 	for i := 0; i < cacheWriteWorkers; i++ {
-		go cacheWriteWorker(cacheWriteChan)
+		go this.cacheWriteWorker(this.cacheWriteChan)
 	}
 
 	for i := 0; i < downloadWorkers; i++ {
-		//go downloadWorker(downloadChan)
 		go func() {
-			for d := range downloadChan {
+			for d := range this.downloadChan {
 				for {
-					mutex.RLock()
-					wait := uploading[d.e.Key]
-					mutex.RUnlock()
+					this.mutex.RLock()
+					wait := this.uploading[d.e.Key]
+					this.mutex.RUnlock()
 					if wait != true {
 						break
 					}
 					time.Sleep(500 * time.Microsecond)
 				}
-				partDownload(d.e, d.buf)
+				d.failed.set(this.partDownload(d.e, d.buf))
 				d.reads.Done()
 			}
 		}()
 	}
 
-	switch gcVersion {
+	switch v.GetInt64("gcVersion") {
 	case 1:
-		go gcthread()
+		go this.gcthread()
 	case 2:
-		go gcthread2()
+		go this.gcthread2()
 	default:
-		go gcthread()
+		go this.gcthread()
 	}
 
-	go func() {
-		if gcMode != "on" && gcMode != "statsOnly" {
-			return
+	go this.stats()
+	go this.replicator()
+
+	return this, nil
+}
+
+// open configures the backend and recovers or creates the volume according to
+// the startup mode. No goroutines are started, so the volume can be also
+// accessed offline.
+func open(v *viper.Viper, vol *backend.Volume) (*ObjectBackend, error) {
+	v.SetEnvPrefix(envPrefix)
+
+	v.BindEnv("api")
+	v.BindEnv("gcMode")
+	v.BindEnv("gcVersion")
+	v.BindEnv("gcPolicy")
+	v.BindEnv("gcBandwidthM")
+	v.BindEnv("gcRequests")
+	v.BindEnv("gcPauseLatencyMs")
+	v.BindEnv("gcMemoryM")
+	v.BindEnv("objectSizeM")
+	v.BindEnv("volume")
+	v.BindEnv("checkpointObjects")
+	v.BindEnv("checkpointMinutes")
+	v.BindEnv("startup")
+	v.BindEnv("compression")
+	v.BindEnv("encryption")
+	v.BindEnv("keyFile")
+	v.BindEnv("key")
+	v.BindEnv("dedup")
+	v.BindEnv("dedupIndex")
+	storeAPI := v.GetString("api")
+	objectSizeM := v.GetInt64("objectSizeM")
+
+	this := &ObjectBackend{
+		name:              vol.Name,
+		cache:             vol.Cache,
+		gc:                gc.New(),
+		workloads:         make(chan *[]extent.Extent),
+		flushes:           make(chan chan struct{}),
+		gcMode:            v.GetString("gcMode"),
+		objectSize:        objectSizeM * 1024 * 1024,
+		checkpointObjects: v.GetInt64("checkpointObjects"),
+		checkpointMinutes: v.GetInt64("checkpointMinutes"),
+		startup:           v.GetString("startup"),
+		uploading:         make(map[int64]bool),
+		cacheWriteChan:    make(chan cacheWriteJob),
+		downloadChan:      make(chan downloadJob),
+		snapshots:         make(map[string]*snapshot),
+		manifest:          &manifest.Manifest{},
+		done:              make(chan struct{}),
+	}
+	this.em = extmap.New(this.gc)
+	this.headerBlocks = header.Size(this.objectSize) / 512
+
+	if this.gcMode != "on" && this.gcMode != "statsOnly" && this.gcMode != "off" && this.gcMode != "silent" && this.objectSize == 0 {
+		return nil, errors.New("invalid gcMode or objectSizeM")
+	}
+
+	var err error
+	this.gcPolicy, err = gc.ParsePolicy(v.GetString("gcPolicy"))
+	if err != nil {
+		return nil, err
+	}
+	this.gcThrottle = throttle.New(
+		v.GetFloat64("gcBandwidthM")*1024*1024,
+		v.GetFloat64("gcRequests"),
+		time.Duration(v.GetInt64("gcPauseLatencyMs"))*time.Millisecond)
+	this.gcMemory = v.GetInt64("gcMemoryM") * 1024 * 1024
+	if this.gcMemory <= 0 {
+		this.gcMemory = defaultGCMemory
+	}
+	this.compression, err = codec.Parse(v.GetString("compression"))
+	if err != nil {
+		return nil, err
+	}
+	err = this.initCrypt(v.GetString("encryption"), v.GetString("keyFile"), v.GetString("key"))
+	if err != nil {
+		return nil, err
+	}
+
+	if this.startup == "" {
+		this.startup = "create"
+	}
+	if this.startup != "recover" && this.startup != "create" && this.startup != "fail-if-exists" && this.startup != "wipe" {
+		return nil, fmt.Errorf("unknown startup mode %q", this.startup)
+	}
+
+	if id := v.GetString("volume"); id != "" {
+		this.volume, err = header.ParseVolume(id)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	this.initInfo()
 
-		fmt.Println("STATS: time,total,valid,invalid,ratio,gcmode")
-		const delaySec = 5
-		for {
-			gc.PrintStats(delaySec, gcMode)
-			time.Sleep(delaySec * time.Second)
+	this.dedup = v.GetBool("dedup")
+	if this.dedup {
+		this.initDedup(v.GetInt("dedupIndex"))
+	}
+
+	p := vol.Config.Sub(parentSection)
+	p.SetEnvPrefix(parentEnvPrefix)
+	p.BindEnv("bucket")
+	p.BindEnv("pool")
+	p.BindEnv("path")
+	p.BindEnv("prefix")
+	p.BindEnv("snapshot")
+	p.BindEnv("seq")
+	this.parentSnapshot = p.GetString("snapshot")
+	this.parentSeq = p.GetInt64("seq")
+
+	st, ps, err := openStore(vol.Config, configSection, storeAPI, p)
+	if err != nil {
+		return nil, err
+	}
+
+	m := vol.Config.Sub(mirrorSection)
+	m.SetEnvPrefix(mirrorEnvPrefix)
+	m.BindEnv("api")
+	if mirrorAPI := m.GetString("api"); mirrorAPI != "" {
+		this.secondary, _, err = openStore(vol.Config, mirrorSection, mirrorAPI, viper.New())
+		if err != nil {
+			return nil, fmt.Errorf("mirror: %w", err)
+		}
+	}
+
+	var rs api.ObjectStore
+	rv := vol.Config.Sub(replicaSection)
+	rv.SetEnvPrefix(replicaEnvPrefix)
+	rv.BindEnv("api")
+	if replicaAPI := rv.GetString("api"); replicaAPI != "" {
+		rs, _, err = openStore(vol.Config, replicaSection, replicaAPI, viper.New())
+		if err != nil {
+			return nil, fmt.Errorf("replica: %w", err)
+		}
+	}
+
+	if f := faults.Init(vol.Config); f != nil {
+		st = f.Wrap(st)
+		if ps != nil {
+			ps = f.Wrap(ps)
+		}
+		if this.secondary != nil {
+			this.secondary = f.Wrap(this.secondary)
+		}
+		if rs != nil {
+			rs = f.Wrap(rs)
+		}
+	}
+	if this.secondary != nil {
+		st = mirror.New(st, this.secondary)
+	}
+
+	meta := &metaCrypt{st, this.sealer, &this.volume}
+	if err := meta.checkKey(); err != nil {
+		return nil, err
+	}
+	this.store = meta
+	if ps != nil {
+		meta := &metaCrypt{ps, this.sealer, nil}
+		if err := meta.checkKey(); err != nil {
+			return nil, fmt.Errorf("parent: %w", err)
+		}
+		this.parent = meta
+	}
+	if rs != nil {
+		this.replica = &replica{source: st, target: rs, meta: &metaCrypt{rs, this.sealer, &this.volume}}
+	}
+
+	if err := this.start(); err != nil {
+		return nil, err
+	}
+
+	if this.volume.IsZero() {
+		this.volume = header.NewVolume()
+	}
+	fmt.Println("Volume:", this.volume)
+
+	return this, nil
+}
+
+// openStore opens the store of the api configured in the subsection of the
+// section named by the api, e.g. backend.object.s3. The parent of a clone is
+// opened too if it is configured in p.
+func openStore(cfg *parser.Config, section, storeAPI string, p *viper.Viper) (api.ObjectStore, api.ObjectStore, error) {
+	sub := section + "." + storeAPI
+	v := cfg.Sub(sub)
+	env := "dis_" + strings.ReplaceAll(sub, ".", "_")
+
+	switch storeAPI {
+	case "s3":
+		s := s3.Configure(v, env)
+		if bucket := p.GetString("bucket"); bucket != "" {
+			return s, s.Open(bucket, p.GetString("prefix")), nil
+		}
+		return s, nil, nil
+	case "rados":
+		s := rados.Configure(v, env)
+		if pool := p.GetString("pool"); pool != "" {
+			return s, s.Open(pool, p.GetString("prefix")), nil
+		}
+		return s, nil, nil
+	case "dir":
+		s := dir.Configure(v, env)
+		if path := p.GetString("path"); path != "" {
+			return s, dir.Open(path, p.GetString("prefix")), nil
+		}
+		return s, nil, nil
+	case "memory":
+		return memory.Configure(v, env), nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown api %q", storeAPI)
+}
+
+func (this *ObjectBackend) stats() {
+	defer this.workers.Done()
+	if this.gcMode != "on" && this.gcMode != "statsOnly" {
+		return
+	}
+
+	fmt.Println("STATS: time,total,valid,invalid,ratio,gcmode,physical")
+	const delaySec = 5
+	for {
+		this.gc.PrintStats(delaySec, this.gcMode)
+		if !this.sleep(delaySec * time.Second) {
+			return
 		}
-	}()
+	}
+}
+
+// sleep waits for the duration and returns false if the backend was closed
+// meanwhile.
+func (this *ObjectBackend) sleep(d time.Duration) bool {
+	select {
+	case <-this.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Close uploads all written data and stops the backend. The kernel must not
+// send any more requests. A checkpoint is written if checkpoints are enabled,
+// so the volume recovers quickly when it is served again.
+func (this *ObjectBackend) Close() error {
+	control.Unhandle(this.name, "/snapshots")
+	control.Unhandle(this.name, "/replication")
+
+	close(this.cacheWriteChan)
+	this.readers.Wait()
+	close(this.downloadChan)
+
+	close(this.done)
+	this.workers.Wait()
+
+	if this.checkpointObjects == 0 && this.checkpointMinutes == 0 {
+		return nil
+	}
+	_, err := this.writeCheckpoint()
+	return err
 }
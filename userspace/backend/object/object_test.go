@@ -0,0 +1,203 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"bytes"
+	"dis/backend"
+	"dis/cache"
+	"dis/extent"
+	"dis/parser"
+	"fmt"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+const (
+	testCacheBase  = 1024
+	testCacheBound = 40000
+	// Reads go to the start of the cache, writes after it
+	testReadSectors = 4096
+)
+
+// testVolume is a volume in a temporary directory, stored by the dir store.
+// The cache file has to support O_DIRECT.
+type testVolume struct {
+	t     *testing.T
+	dir   string
+	cfg   *parser.Config
+	cache *cache.Cache
+	pba   int64
+}
+
+// newTestVolume creates the configuration of a volume with the GC thread
+// disabled. The settings are added to [backend.object]. Unless they set the
+// api and objectSizeM, the volume is stored by the dir store in 1 MiB objects.
+func newTestVolume(t *testing.T, settings string) *testVolume {
+	dir, err := ioutil.TempDir("", "dis-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "cache.img")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, testCacheBound*512); err != nil {
+		t.Fatal(err)
+	}
+
+	this := &testVolume{t: t, dir: dir, pba: testCacheBase + testReadSectors}
+	this.configure(settings)
+
+	this.cache, err = cache.New(this.cfg)
+	if err != nil {
+		t.Skip("cache file not usable:", err)
+	}
+	t.Cleanup(func() { this.cache.Close() })
+
+	return this
+}
+
+// configure replaces the settings of the volume, which apply once it is
+// opened again.
+func (this *testVolume) configure(settings string) {
+	if !hasKey(settings, "objectSizeM") {
+		settings = "objectSizeM = 1\n" + settings
+	}
+	if !hasKey(settings, "api") {
+		settings = "api = \"dir\"\n" + settings
+	}
+	conf := fmt.Sprintf(`[cache]
+base = %v
+bound = %v
+file = %q
+
+[backend.object]
+gcMode = "off"
+%v
+
+[backend.object.dir]
+path = %q
+`, testCacheBase, testCacheBound, filepath.Join(this.dir, "cache.img"), settings, filepath.Join(this.dir, "store"))
+	name := filepath.Join(this.dir, "config.toml")
+	if err := ioutil.WriteFile(name, []byte(conf), 0600); err != nil {
+		this.t.Fatal(err)
+	}
+
+	var err error
+	this.cfg, err = parser.Load(name)
+	if err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+// hasKey returns true if the settings set the key before any subsection.
+func hasKey(settings, key string) bool {
+	for _, line := range strings.Split(settings, "\n") {
+		if strings.HasPrefix(line, "[") {
+			return false
+		}
+		if strings.HasPrefix(line, key+" ") || strings.HasPrefix(line, key+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *testVolume) open() *ObjectBackend {
+	b, err := New(this.cfg.Sub(configSection), &backend.Volume{Name: this.t.Name(), Config: this.cfg, Cache: this.cache})
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	return b.(*ObjectBackend)
+}
+
+func (this *testVolume) close(b *ObjectBackend) {
+	if err := b.Close(); err != nil {
+		this.t.Fatal(err)
+	}
+}
+
+// objects returns the sizes of the objects in the store.
+func (this *testVolume) objects() map[int64]int64 {
+	objects := make(map[int64]int64)
+	st, _, err := openStore(this.cfg, configSection, "dir", viper.New())
+	if err != nil {
+		this.t.Fatal(err)
+	}
+	err = st.List(-1, func(key, size int64) {
+		objects[key] = size
+	})
+	if err != nil {
+		this.t.Fatal(err)
+	}
+
+	return objects
+}
+
+// alignedBuffer returns a buffer usable for O_DIRECT.
+func alignedBuffer(n int64) []byte {
+	buf := make([]byte, n+4096)
+	off := 4096 - int(uintptr(unsafe.Pointer(&buf[0]))%4096)
+	return buf[off : off+int(n)]
+}
+
+// write writes random data of n sectors at the lba and returns them.
+func (this *testVolume) write(b *ObjectBackend, lba, n int64) []byte {
+	if this.pba+n > testCacheBound {
+		this.t.Fatal("test cache is full")
+	}
+	data := alignedBuffer(n * 512)
+	rand.Read(data)
+	if err := this.cache.Write(&data, this.pba*512); err != nil {
+		this.t.Fatal(err)
+	}
+
+	extents := []extent.Extent{{LBA: lba, PBA: this.pba, Len: n}}
+	if err := b.Write(&extents); err != nil {
+		this.t.Fatal(err)
+	}
+	this.pba += n
+
+	return data
+}
+
+// waitForObjects waits until the writer uploads the number of objects.
+func (this *testVolume) waitForObjects(b *ObjectBackend, objects int64) {
+	for atomic.LoadInt64(&b.seqNumber) < objects {
+		time.Sleep(time.Millisecond)
+	}
+	b.waitForUploads(objects)
+}
+
+// check reads n sectors at the lba into the start of the cache and compares
+// them with the data.
+func (this *testVolume) check(b *ObjectBackend, lba, n int64, data []byte) {
+	if n > testReadSectors {
+		this.t.Fatal("read is too large")
+	}
+	extents := []extent.Extent{{LBA: lba, PBA: testCacheBase, Len: n}}
+	if err := b.Read(&extents); err != nil {
+		this.t.Fatal(err)
+	}
+	got := alignedBuffer(n * 512)
+	if err := this.cache.Read(&got, testCacheBase*512); err != nil {
+		this.t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		this.t.Fatalf("data at %v differ", lba)
+	}
+}
@@ -5,9 +5,7 @@ package object
 
 import (
 	"dis/backend/object/extmap"
-	"dis/cache"
 	"dis/extent"
-	"dis/l2cache"
 	"sync"
 	"time"
 	//"fmt"
@@ -18,82 +16,68 @@ const (
 	cacheWriteWorkers = 20
 )
 
-var (
-	cacheWriteChan = make(chan cacheWriteJob)
-	downloadChan   = make(chan downloadJob)
-)
-
-func partDownload(e *extmap.Extent, slice *[]byte) {
-	downloadF(e.Key, slice, e.PBA*512, (e.PBA+e.Len)*512-1)
+func (this *ObjectBackend) partDownload(e *extmap.Extent, slice *[]byte) error {
+	from, to := e.PBA*512, (e.PBA+e.Len)*512
+	info, err := this.infoOf(e.Key)
+	if err != nil {
+		return err
+	}
+	if info.frames != nil {
+		return this.framedDownload(e.Key, info, *slice, from, to)
+	}
+	return this.verifiedDownload(e.Key, slice, from, to)
 }
 
 type cacheWriteJob struct {
 	e     *extent.Extent
 	reads *sync.WaitGroup
+	errs  *extent.Collector
 }
 
 type downloadJob struct {
-	e     *extmap.Extent
-	buf   *[]byte
-	reads *sync.WaitGroup
+	e      *extmap.Extent
+	buf    *[]byte
+	reads  *sync.WaitGroup
+	failed *failure
 }
 
-func fillPartFromChunk(slice []byte, chunkI int64, chunkTo, chunkFrom int64, wg *sync.WaitGroup, key int64) {
-	id := func(key, chunk int64) int64 {
-		return key*1000 + chunk
+// failure keeps the first error of a group of concurrent jobs.
+type failure struct {
+	mutex sync.Mutex
+	err   error
+}
+
+func (this *failure) set(err error) {
+	if err == nil {
+		return
 	}
 
-	cacheKey := id(key, chunkI)
-again:
-	chunk, ok := l2cache.GetOrReserveChunk(cacheKey)
-	if !ok {
-		buf := make([]byte, l2cache.ChunkSize)
-		downloadF(key, &buf, chunkI*l2cache.ChunkSize, chunkI*l2cache.ChunkSize+l2cache.ChunkSize-1)
-		l2cache.PutChunk(cacheKey, &buf)
-		chunk = &buf
-	} else if chunk == nil {
-		time.Sleep(100 * time.Microsecond)
-		goto again
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.err == nil {
+		this.err = err
 	}
-	copy(slice, (*chunk)[chunkFrom:chunkTo])
-	wg.Done()
 }
 
-func downloadWorker(jobs <-chan downloadJob) {
-	for job := range jobs {
-		first := job.e.PBA * 512 / l2cache.ChunkSize
-		last := (job.e.PBA + job.e.Len - 1) * 512 / l2cache.ChunkSize
-		part := *job.buf
-		var waitChunks sync.WaitGroup
-		waitChunks.Add(int(last - first + 1))
-		for i := first; i <= last; i++ {
-			chunkFrom, chunkTo := int64(0), int64(l2cache.ChunkSize)
-			if i == first {
-				chunkFrom = job.e.PBA * 512 % l2cache.ChunkSize
-			}
-
-			if i == last {
-				chunkTo = ((job.e.PBA+job.e.Len)*512-1)%l2cache.ChunkSize + 1
-			}
-			go fillPartFromChunk(part, i, chunkTo, chunkFrom, &waitChunks, job.e.Key)
+func (this *failure) get() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
 
-			if i != last {
-				part = part[chunkTo-chunkFrom:]
-			}
-		}
-		waitChunks.Wait()
-		job.reads.Done()
-	}
+	return this.err
 }
 
-func cacheWriteWorker(jobs <-chan cacheWriteJob) {
+func (this *ObjectBackend) cacheWriteWorker(jobs <-chan cacheWriteJob) {
+	defer this.readers.Done()
 	for job := range jobs {
 		buf := make([]byte, job.e.Len*512)
 		s3reads := new(sync.WaitGroup)
+		failed := new(failure)
+		start := time.Now()
+		var downloads int
 
 		//em.RLock()
 
-		for _, e := range *em.Find(job.e) {
+		for _, e := range *this.em.Find(job.e) {
 			if e.Key == -1 {
 				//em.Dump()
 				continue
@@ -102,27 +86,38 @@ func cacheWriteWorker(jobs <-chan cacheWriteJob) {
 			ss := s + e.Len*512
 			slice := buf[s:ss]
 			s3reads.Add(1)
-			downloadChan <- downloadJob{e, &slice, s3reads}
+			downloads++
+			this.downloadChan <- downloadJob{e, &slice, s3reads, failed}
 		}
 
 		//em.RUnlock()
 
 		s3reads.Wait()
-		cache.Write(&buf, job.e.PBA*512)
+		if downloads > 0 {
+			this.gcThrottle.Observe(time.Since(start))
+		}
+		err := failed.get()
+		if err == nil {
+			err = this.cache.Write(&buf, job.e.PBA*512)
+		}
+		job.errs.Add(job.e, err)
 		job.reads.Done()
 	}
 }
 
-func (this *ObjectBackend) Read(extents *[]extent.Extent) {
+func (this *ObjectBackend) Read(extents *[]extent.Extent) error {
 	var reads sync.WaitGroup
+	var errs extent.Collector
 
 	reads.Add(len(*extents))
 	for i := range *extents {
 		e := &(*extents)[i]
-		cacheWriteChan <- cacheWriteJob{e, &reads}
+		this.cacheWriteChan <- cacheWriteJob{e, &reads, &errs}
 	}
 	reads.Wait()
 	//e := extent.Extent{296, -1, 8}
 	//r := *em.Find(&e)
 	//fmt.Println("XXX:", *r[0])
+
+	return errs.Err()
 }
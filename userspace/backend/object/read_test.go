@@ -0,0 +1,61 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/extent"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A truncated object must fail the read, not return zeros.
+func TestReadOfTruncatedObject(t *testing.T) {
+	tv := newTestVolume(t, "")
+	const n = 1000
+
+	b := tv.open()
+	tv.write(b, 0, n)
+	tv.close(b)
+
+	file := filepath.Join(tv.dir, "store", "00000000")
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = tv.open()
+	defer tv.close(b)
+	for _, size := range []int{0, 4096} {
+		if err := ioutil.WriteFile(file, buf[:size], 0600); err != nil {
+			t.Fatal(err)
+		}
+		b.infoCache.Purge()
+		extents := []extent.Extent{{LBA: 0, PBA: testCacheBase, Len: n}}
+		if err := b.Read(&extents); err == nil {
+			t.Errorf("read of an object truncated to %v bytes succeeded", size)
+		}
+	}
+}
+
+// The memory store holds the volume only while it is open.
+func TestMemoryStore(t *testing.T) {
+	tv := newTestVolume(t, `api = "memory"`)
+	const n = 1000
+
+	b := tv.open()
+	defer tv.close(b)
+	data := make(map[int64][]byte)
+	for i := int64(0); i < 3; i++ {
+		data[i*n] = tv.write(b, i*n, n)
+	}
+	copy(data[n], tv.write(b, n, n/2))
+	// Pushes the object with the writes above out of the writer
+	tv.write(b, 3*n, n)
+	tv.waitForObjects(b, 2)
+
+	for lba, d := range data {
+		tv.check(b, lba, n, d)
+	}
+}
@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"dis/backend/object/checkpoint"
+	"dis/backend/object/extmap"
+	"dis/backend/object/header"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+var errCorrupted = errors.New("object is corrupted")
+
+// start prepares the object store according to the startup mode. Existing
+// data are destroyed only in the wipe mode. Errors of the object store are
+// fatal here, as the volume cannot be served before it is recovered. A clone
+// whose parent is missing or unusable fails with an error instead.
+//
+//	recover         recover the volume, fail if there is none
+//	create          recover the volume if there is one, create it otherwise
+//	fail-if-exists  create a new volume, fail if there is one
+//	wipe            delete all objects in the store and create a new volume
+func (this *ObjectBackend) start() error {
+	found := this.store.Exists()
+	if found {
+		e, err := this.store.Empty()
+		if err != nil {
+			panic(err)
+		}
+		found = !e
+	}
+
+	switch this.startup {
+	case "recover", "create":
+		if found {
+			fmt.Println("Recovering volume")
+			if err := this.recoverVolume(); err != nil {
+				return err
+			}
+			if this.clone && this.parent == nil {
+				return errNoParent
+			}
+			return nil
+		}
+		if this.startup == "recover" {
+			panic("Object store contains no volume to recover")
+		}
+	case "fail-if-exists":
+		if found {
+			panic("Object store already contains a volume, refusing to create a new one")
+		}
+	case "wipe":
+		if found {
+			fmt.Println("Wiping object store")
+			if err := this.store.Wipe(); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	fmt.Println("Creating new volume")
+	if err := this.store.Create(); err != nil {
+		panic(err)
+	}
+
+	if this.parent != nil {
+		if this.volume.IsZero() {
+			this.volume = header.NewVolume()
+		}
+		if err := this.loadParent(); err != nil {
+			return fmt.Errorf("parent: %w", err)
+		}
+
+		// The initial checkpoint makes the clone recoverable without
+		// looking at the parent again.
+		if _, err := this.writeCheckpoint(); err != nil {
+			panic(err)
+		}
+	}
+
+	return nil
+}
+
+// recoverVolume rebuilds the extent map and the usage table from the newest
+// valid checkpoint and the headers of objects written after it. Interrupted GC
+// runs are finished first. Objects are replayed in the key order up to the
+// first missing key which is not in the manifest, everything after the gap is
+// deleted and its keys are added to the manifest. An object with a corrupted header fails the recovery, the volume is
+// left as it is then. Empty objects left by older versions of the GC are moved
+// to the manifest.
+func (this *ObjectBackend) recoverVolume() error {
+	m, err := loadManifest(this.store, this.volume)
+	if err != nil {
+		panic(err)
+	}
+	this.manifest = m
+	if this.volume.IsZero() {
+		this.volume = m.Volume
+	}
+	this.recoverGC()
+	cut := this.loadCheckpoint()
+
+	m = this.collected()
+	lastKey := cut - 1
+	var finished bool
+	var failed error
+	var voided []int64
+	err = this.store.List(lastKey, func(key, size int64) {
+		if failed != nil {
+			return
+		}
+		if finished {
+			this.deleteObject(key)
+			return
+		}
+		if m.Contains(key) {
+			// Collected, but the deletion did not finish
+			this.deleteObject(key)
+			return
+		}
+		if (cut != 0 || lastKey != -1) && key != m.Next(lastKey+1) {
+			finished = true
+			this.deleteObject(key)
+			return
+		}
+		if size == 0 {
+			voided = append(voided, key)
+		} else if err := this.recoverHeader(key, size); err != nil {
+			failed = err
+			return
+		}
+		lastKey = key
+	})
+	if err != nil {
+		panic(err)
+	}
+	if failed != nil {
+		return failed
+	}
+
+	// Keys past the end are not assigned again, as a replica may still hold
+	// the objects
+	if n := len(m.Ranges); len(voided) > 0 || n > 0 && m.Ranges[n-1].To > lastKey+1 {
+		if err := this.updateManifest(m.Filled(lastKey + 1).With(voided)); err != nil {
+			panic(err)
+		}
+	}
+	for _, key := range voided {
+		this.deleteObject(key)
+	}
+
+	atomic.StoreInt64(&this.seqNumber, this.collected().Next(lastKey+1))
+	fmt.Println("Recovered objects up to key", lastKey)
+	return nil
+}
+
+// deleteObject deletes an object past the end of the volume or a collected one.
+// A failure is not fatal, the object is deleted again by the next recovery.
+func (this *ObjectBackend) deleteObject(key int64) {
+	if err := this.store.Delete(key); err != nil {
+		fmt.Println("Object", key, "not deleted:", err)
+	}
+}
+
+// loadCheckpoint loads the newest valid checkpoint into the extent map and
+// the usage table. It returns the first key not covered by the checkpoint or
+// zero if there is none.
+func (this *ObjectBackend) loadCheckpoint() int64 {
+	names, err := this.store.ListMeta(checkpointPrefix)
+	if err != nil {
+		panic(err)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		buf, err := this.store.GetMeta(name)
+		if err != nil {
+			panic(err)
+		}
+		cp, err := checkpoint.Decode(buf)
+		if err != nil {
+			fmt.Println("Checkpoint", name, "rejected:", err)
+			continue
+		}
+		if !this.volume.IsZero() && this.volume != cp.Volume {
+			panic(fmt.Sprintf("Checkpoint %v belongs to volume %v, expected %v", name, cp.Volume, this.volume))
+		}
+
+		this.volume = cp.Volume
+		m := this.collected()
+		for k, size := range cp.Objects {
+			// Collected after the checkpoint was written
+			if m.Contains(k) {
+				continue
+			}
+			this.gc.Create(k, size.Total)
+			this.gc.SetPhysical(k, size.Physical)
+		}
+		for i := range cp.Extents {
+			this.mapExtent(&cp.Extents[i])
+		}
+
+		fmt.Println("Loaded checkpoint", name)
+		return cp.Seq
+	}
+
+	return 0
+}
+
+// recoverHeader downloads the header of the object and replays it into the
+// extent map. Invalid headers are downloaded again, also from the secondary
+// store if the objects are mirrored, before the object is reported corrupted.
+func (this *ObjectBackend) recoverHeader(key, size int64) error {
+	var err error
+	for i := 0; i <= checksumRetries; i++ {
+		var buf []byte
+		if buf, err = readHeader(this.store, key, size); err == nil {
+			if err = this.headerToMap(buf, key, size); err == nil {
+				return nil
+			}
+		}
+	}
+
+	if this.secondary != nil {
+		buf, serr := readHeader(this.secondary, key, size)
+		if serr == nil {
+			if serr = this.headerToMap(buf, key, size); serr == nil {
+				fmt.Println("Object", key, "header read from the secondary store")
+				return nil
+			}
+		}
+		err = fmt.Errorf("%v, secondary: %w", err, serr)
+	}
+
+	return err
+}
+
+// readHeader downloads the whole header of the object from the store.
+// Download errors panic, they must not make the object look corrupted.
+func readHeader(st api.ObjectStore, key, size int64) ([]byte, error) {
+	buf, err := tryReadHeader(st, key, size)
+	if err != nil && !errors.Is(err, errCorrupted) {
+		panic(err)
+	}
+
+	return buf, err
+}
+
+// tryReadHeader is readHeader returning download errors.
+func tryReadHeader(st api.ObjectStore, key, size int64) ([]byte, error) {
+	first := make([]byte, header.FixedSize)
+	if size < header.FixedSize {
+		first = first[:size]
+	}
+	if err := st.GetRange(key, first, 0); err != nil {
+		return nil, fmt.Errorf("object %v: %w", key, err)
+	}
+
+	headerSize, _ := header.Peek(first, size)
+	if headerSize > size || headerSize < int64(len(first)) {
+		return nil, fmt.Errorf("object %v: %w: invalid header size %v", key, errCorrupted, headerSize)
+	}
+
+	buf := make([]byte, headerSize)
+	copy(buf, first)
+	if rest := buf[len(first):]; len(rest) > 0 {
+		if err := st.GetRange(key, rest, int64(len(first))); err != nil {
+			return nil, fmt.Errorf("object %v: %w", key, err)
+		}
+	}
+
+	return buf, nil
+}
+
+// headerToMap replays the header of a recovered object into the extent map.
+func (this *ObjectBackend) headerToMap(buf []byte, key, size int64) error {
+	extents, total, physical, vol, err := this.headerExtents(buf, key, size)
+	if err != nil {
+		return err
+	}
+
+	if vol.IsZero() {
+		// Legacy object without the volume identification
+	} else if this.volume.IsZero() {
+		this.volume = vol
+	} else if this.volume != vol {
+		return fmt.Errorf("object %v belongs to volume %v, expected %v", key, vol, this.volume)
+	}
+
+	atomic.StoreInt64(&this.seqNumber, key+1)
+
+	this.gc.Create(key, total)
+	this.gc.SetPhysical(key, physical)
+	for i := range extents {
+		this.mapExtent(&extents[i])
+	}
+
+	return nil
+}
+
+// mapExtent inserts a recovered extent into the extent map and notes whether
+// the volume is a clone.
+func (this *ObjectBackend) mapExtent(e *extmap.Extent) {
+	if vol, _ := extmap.SplitKey(e.Key); vol == parentVolume {
+		this.clone = true
+	}
+	this.em.UpdateSingle(e)
+}
+
+// headerExtents decodes extents stored in the header of the object together
+// with the total and physical size of its data and the volume it belongs to.
+func (this *ObjectBackend) headerExtents(buf []byte, key, size int64) ([]extmap.Extent, int64, int64, header.Volume, error) {
+	var extents []extmap.Extent
+
+	if _, legacy := header.Peek(buf, size); legacy {
+		if this.sealer != nil {
+			return nil, 0, 0, header.Volume{}, fmt.Errorf("object %v: %w", key, errPlain)
+		}
+		blocks := header.LegacySize(size) / 512
+		header.LegacyEntries(buf, func(lba, length int64) {
+			extents = append(extents, extmap.Extent{LBA: lba, PBA: blocks, Len: length, Key: key})
+			blocks += length
+		})
+		return extents, size / 512, size / 512, header.Volume{}, nil
+	}
+
+	h, err := header.Parse(buf)
+	if err != nil {
+		return nil, 0, 0, header.Volume{}, fmt.Errorf("object %v: %w: %v", key, errCorrupted, err)
+	}
+	if h.Seq != key {
+		return nil, 0, 0, header.Volume{}, fmt.Errorf("object %v: %w: header claims key %v", key, errCorrupted, h.Seq)
+	}
+	if err := this.openIndex(h, h.Index(buf)); err != nil {
+		return nil, 0, 0, header.Volume{}, fmt.Errorf("object %v: %w", key, err)
+	}
+
+	blocks := h.LogicalStart / 512
+	for i := int64(0); i < h.Extents; i++ {
+		lba, length := h.Entry(buf, i)
+		if length < 0 {
+			i++
+			k, pba := h.Entry(buf, i)
+			extents = append(extents, extmap.Extent{LBA: lba, PBA: pba, Len: -length, Key: k})
+			continue
+		}
+		extents = append(extents, extmap.Extent{LBA: lba, PBA: blocks, Len: length, Key: key})
+		blocks += length
+	}
+
+	total := blocks - h.LogicalStart/512
+	physical := total
+	if h.Frames != 0 {
+		physical = (h.DataSize + 511) / 512
+	}
+
+	return extents, total, physical, h.Volume, nil
+}
@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend"
+	"dis/backend/object/journal"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecoveryAfterCollection(t *testing.T) {
+	tv := newTestVolume(t, "")
+	const n = 1024
+
+	b := tv.open()
+	tv.write(b, 0, n)
+	kept := tv.write(b, n, n)
+	tv.write(b, 2*n, n)
+	overwritten := tv.write(b, 0, n)
+	tv.close(b)
+
+	b = tv.open()
+	if _, err := b.writeCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.gcRun2(&map[int64]bool{0: true}); err != nil {
+		t.Fatal(err)
+	}
+	tv.close(b)
+	if _, ok := tv.objects()[0]; ok {
+		t.Fatal("collected object was not deleted")
+	}
+
+	b = tv.open()
+	defer tv.close(b)
+	if b.gc.Alive(0) {
+		t.Fatal("collected object is tracked by the GC again")
+	}
+	if purgeSet := b.gc.PurgeSet(b.gcPolicy); (*purgeSet)[0] {
+		t.Fatal("collected object is selected by the GC again")
+	}
+	tv.check(b, 0, n, overwritten)
+	tv.check(b, n, n, kept)
+}
+
+func TestManifestOfJournalNamesVolume(t *testing.T) {
+	tv := newTestVolume(t, "")
+	b := tv.open()
+	tv.write(b, 0, 8)
+	tv.close(b)
+	vol := b.volume
+
+	st, _, err := openStore(tv.cfg, configSection, "dir", viper.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A committed run which crashed before its victims were deleted
+	r := &journal.Record{Volume: vol, First: 1, End: 1, Committed: true, Victims: []int64{}}
+	if err := st.PutMeta(fmt.Sprintf(journalFmt, r.First), journal.Encode(r)); err != nil {
+		t.Fatal(err)
+	}
+
+	tv.close(tv.open())
+	m, err := loadManifest(st, vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Volume != vol {
+		t.Fatalf("manifest belongs to volume %v, expected %v", m.Volume, vol)
+	}
+}
+
+func TestRecoveryOfCorruptedHeader(t *testing.T) {
+	tv := newTestVolume(t, "")
+	const n = 1024
+
+	b := tv.open()
+	for i := int64(0); i < 4; i++ {
+		tv.write(b, i*n, n)
+	}
+	tv.close(b)
+	before := tv.objects()
+
+	f, err := os.OpenFile(filepath.Join(tv.dir, "store", "00000001"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, 40); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	_, err = New(tv.cfg.Sub(configSection), &backend.Volume{Name: t.Name(), Config: tv.cfg, Cache: tv.cache})
+	if !errors.Is(err, errCorrupted) {
+		t.Fatal("corrupted object recovered:", err)
+	}
+	if after := tv.objects(); len(after) != len(before) {
+		t.Fatalf("%v objects left of %v", len(after), len(before))
+	}
+}
+
+func TestRolledBackKeysNotReused(t *testing.T) {
+	tv := newTestVolume(t, "")
+	const n = 1024
+
+	b := tv.open()
+	data := make([][]byte, 4)
+	for i := int64(0); i < 4; i++ {
+		data[i] = tv.write(b, i*n, n)
+	}
+	tv.close(b)
+	vol := b.volume
+
+	st, _, err := openStore(tv.cfg, configSection, "dir", viper.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Object 2 belongs to a run which crashed before the commit, object 3
+	// was written after the run
+	r := &journal.Record{Volume: vol, First: 2, End: 3, Victims: []int64{0}}
+	if err := st.PutMeta(fmt.Sprintf(journalFmt, r.First), journal.Encode(r)); err != nil {
+		t.Fatal(err)
+	}
+
+	b = tv.open()
+	if seq := atomic.LoadInt64(&b.seqNumber); seq != 4 {
+		t.Errorf("next key is %v, expected 4", seq)
+	}
+	if m := b.collected(); !m.Contains(2) || m.Contains(3) {
+		t.Errorf("manifest %v, expected key 2", m.Ranges)
+	}
+	tv.check(b, 3*n, n, data[3])
+	tv.write(b, 0, n)
+	tv.close(b)
+
+	b = tv.open()
+	defer tv.close(b)
+	if seq := atomic.LoadInt64(&b.seqNumber); seq != 5 {
+		t.Errorf("next key is %v, expected 5", seq)
+	}
+	if objects := tv.objects(); len(objects) != 4 {
+		t.Errorf("objects %v left, expected 4", objects)
+	}
+}
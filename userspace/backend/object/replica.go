@@ -0,0 +1,316 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	replicaSection   = "backend.object.replica"
+	replicaEnvPrefix = "dis_backend_object_replica"
+
+	replicaPeriod = time.Second
+)
+
+// replica copies the volume to another store in the background. Objects are
+// copied in the order of their keys and only once all objects with lower keys
+// are uploaded, so the replica always holds a prefix of the log, which the
+// recovery accepts as a crash-consistent volume.
+type replica struct {
+	// Objects are copied as they are, metadata are sealed again
+	source api.ObjectStore
+	target api.ObjectStore
+	meta   api.ObjectStore
+
+	mutex sync.Mutex
+	next  int64 // Lowest key not copied yet
+	// Changes of the primary store which are repeated once the objects
+	// written before them are copied
+	ops []replicaOp
+	// Times the keys became available for copying, each mark covers the keys
+	// up to the following one
+	marks []replicaMark
+	seen  int64
+}
+
+type replicaOp struct {
+	seq   int64
+	what  string
+	apply func() error
+}
+
+type replicaMark struct {
+	key int64
+	at  time.Time
+}
+
+// startReplica prepares the replica and finds the prefix of the log it
+// already holds, so a restarted volume continues where it stopped.
+func (this *ObjectBackend) startReplica() error {
+	r := this.replica
+	if !r.target.Exists() {
+		if err := r.target.Create(); err != nil {
+			return err
+		}
+	}
+
+	// Keys collected by the GC are deleted from the replica as well
+	m, err := loadManifest(r.meta, this.volume)
+	if err != nil {
+		return err
+	}
+	err = r.target.List(-1, func(key, size int64) {
+		if key == m.Next(r.next) {
+			r.next = key + 1
+		}
+	})
+	if err != nil {
+		return err
+	}
+	r.next = m.Next(r.next)
+	if seq := atomic.LoadInt64(&this.seqNumber); r.next > seq {
+		return fmt.Errorf("replica holds %v objects, the volume only %v", r.next, seq)
+	}
+	r.seen = r.next
+	if err := this.syncSnapshots(r); err != nil {
+		return err
+	}
+	fmt.Println("Replica holds", r.next, "objects")
+
+	return nil
+}
+
+// syncSnapshots queues changes making the snapshots of the replica match the
+// ones of the volume, which may have changed while it was not replicated.
+func (this *ObjectBackend) syncSnapshots(r *replica) error {
+	names, err := r.meta.ListMeta(snapshotPrefix)
+	if err != nil {
+		return err
+	}
+	replicated := make(map[string]bool)
+	for _, name := range names {
+		replicated[name] = true
+	}
+
+	this.snapshotMutex.Lock()
+	defer this.snapshotMutex.Unlock()
+
+	for _, name := range names {
+		if this.snapshots[strings.TrimPrefix(name, snapshotPrefix)] != nil {
+			continue
+		}
+		name := name
+		r.ops = append(r.ops, replicaOp{0, "Deletion of " + name, func() error {
+			return r.meta.DeleteMeta(name)
+		}})
+	}
+
+	var missing []replicaOp
+	for name, s := range this.snapshots {
+		name := snapshotPrefix + name
+		if replicated[name] {
+			continue
+		}
+		buf, err := this.store.GetMeta(name)
+		if err != nil {
+			return err
+		}
+		missing = append(missing, replicaOp{s.seq, "Snapshot " + name, func() error {
+			return r.meta.PutMeta(name, buf)
+		}})
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].seq < missing[j].seq
+	})
+	r.ops = append(r.ops, missing...)
+
+	return nil
+}
+
+// replicateAfter queues a change of the primary store. It is repeated on the
+// replica once all objects with keys lower than the current sequence number
+// are copied.
+func (this *ObjectBackend) replicateAfter(what string, apply func(st api.ObjectStore) error) {
+	r := this.replica
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.ops = append(r.ops, replicaOp{
+		seq:   atomic.LoadInt64(&this.seqNumber),
+		what:  what,
+		apply: func() error { return apply(r.meta) },
+	})
+	r.mutex.Unlock()
+}
+
+// durable returns the lowest key which is not uploaded yet.
+func (this *ObjectBackend) durable() int64 {
+	// Keys are assigned and marked as uploading under the lock
+	this.gc.Running.Lock()
+	defer this.gc.Running.Unlock()
+
+	seq := atomic.LoadInt64(&this.seqNumber)
+	this.mutex.RLock()
+	for k := range this.uploading {
+		if k < seq {
+			seq = k
+		}
+	}
+	this.mutex.RUnlock()
+
+	return seq
+}
+
+func (this *ObjectBackend) replicator() {
+	defer this.workers.Done()
+	r := this.replica
+	if r == nil {
+		return
+	}
+
+	for this.sleep(replicaPeriod) {
+		limit := this.durable()
+		r.mark(limit)
+
+		for r.next < limit && r.applyOps() {
+			if err := this.copyObject(r.next); err != nil {
+				fmt.Println("Object", r.next, "not replicated:", err)
+				break
+			}
+			r.mutex.Lock()
+			r.next++
+			r.mutex.Unlock()
+
+			select {
+			case <-this.done:
+				return
+			default:
+			}
+		}
+		r.applyOps()
+	}
+}
+
+func (this *ObjectBackend) copyObject(key int64) error {
+	r := this.replica
+	if this.collected().Contains(key) {
+		// The replica gets the manifest once it catches up
+		return r.target.Put(key, nil)
+	}
+
+	size, err := r.source.Head(key)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if size > 0 {
+		if err := r.source.GetRange(key, buf, 0); err != nil {
+			return err
+		}
+	}
+
+	return r.target.Put(key, buf)
+}
+
+// applyOps repeats the queued changes the replica has caught up with and
+// returns false if one of them failed. The changes are applied in the order
+// they were made on the primary store.
+func (this *replica) applyOps() bool {
+	for {
+		this.mutex.Lock()
+		if len(this.ops) == 0 || this.ops[0].seq > this.next {
+			this.mutex.Unlock()
+			return true
+		}
+		op := this.ops[0]
+		this.mutex.Unlock()
+
+		if err := op.apply(); err != nil {
+			fmt.Println(op.what, "not replicated:", err)
+			return false
+		}
+
+		this.mutex.Lock()
+		this.ops = this.ops[1:]
+		this.mutex.Unlock()
+	}
+}
+
+func (this *replica) mark(limit int64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if limit > this.seen {
+		this.marks = append(this.marks, replicaMark{this.seen, time.Now()})
+		this.seen = limit
+	}
+	for len(this.marks) > 1 && this.marks[1].key <= this.next {
+		this.marks = this.marks[1:]
+	}
+}
+
+// lag returns the number of uploaded objects not copied yet and the time
+// since the oldest of them was uploaded.
+func (this *replica) lag() (int64, time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.next >= this.seen || len(this.marks) == 0 {
+		return 0, 0
+	}
+	i := sort.Search(len(this.marks), func(i int) bool {
+		return this.marks[i].key > this.next
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return this.seen - this.next, time.Since(this.marks[i].at)
+}
+
+// replicateCheckpoint copies the checkpoint and deletes the old ones from the
+// replica as the primary store does.
+func (this *ObjectBackend) replicateCheckpoint(name string, buf []byte) {
+	this.replicateAfter("Checkpoint "+name, func(st api.ObjectStore) error {
+		if err := st.PutMeta(name, buf); err != nil {
+			return err
+		}
+		names, err := st.ListMeta(checkpointPrefix)
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for i := 0; i < len(names)-checkpointsKept; i++ {
+			if err := st.DeleteMeta(names[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (this *ObjectBackend) replicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys, age := this.replica.lag()
+	this.replica.mutex.Lock()
+	next, pending := this.replica.next, len(this.replica.ops)
+	this.replica.mutex.Unlock()
+
+	fmt.Fprintln(w, "replicated lagKeys lagSeconds pendingChanges")
+	fmt.Fprintf(w, "%v %v %.1f %v\n", next, keys, age.Seconds(), pending)
+}
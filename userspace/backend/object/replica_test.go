@@ -0,0 +1,63 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForReplica waits until the replica holds all objects and changes.
+func waitForReplica(t *testing.T, b *ObjectBackend) {
+	r := b.replica
+	for i := 0; ; i++ {
+		r.mutex.Lock()
+		done := r.next == atomic.LoadInt64(&b.seqNumber) && len(r.ops) == 0
+		r.mutex.Unlock()
+		if done {
+			return
+		}
+		if i == 1000 {
+			t.Fatal("replica does not catch up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A restarted replica continues after the objects collected by the GC.
+func TestReplicaResumesAfterCollection(t *testing.T) {
+	tv := newTestVolume(t, "")
+	replica := filepath.Join(tv.dir, "replica")
+	tv.configure(fmt.Sprintf("[backend.object.replica]\napi = \"dir\"\n[backend.object.replica.dir]\npath = %q", replica))
+	const n = 1000
+
+	b := tv.open()
+	tv.write(b, 0, n)
+	tv.write(b, n, n)
+	tv.write(b, 2*n, n)
+	tv.write(b, 0, n)
+	tv.write(b, 3*n, n)
+	tv.waitForObjects(b, 2)
+	waitForReplica(t, b)
+
+	if err := b.gcRun2(&map[int64]bool{0: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitForReplica(t, b)
+	if _, err := os.Stat(filepath.Join(replica, "00000000")); !os.IsNotExist(err) {
+		t.Fatal("collected object was not deleted from the replica:", err)
+	}
+	replicated := b.replica.next
+	tv.close(b)
+
+	b = tv.open()
+	defer tv.close(b)
+	if b.replica.next != replicated {
+		t.Fatalf("replica continues from %v, it holds %v objects", b.replica.next, replicated)
+	}
+}
@@ -0,0 +1,182 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package object
+
+import (
+	"dis/backend/object/api"
+	"dis/backend/object/checkpoint"
+	"dis/backend/object/gc"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const snapshotPrefix = "snapshot-"
+
+var snapshotName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// snapshot is the extent map as of key seq. Objects referenced by the map are
+// pinned so the GC does not void them while the snapshot exists.
+type snapshot struct {
+	seq  int64
+	keys map[int64]bool
+	gc   *gc.Collector
+}
+
+func (this *ObjectBackend) newSnapshot(cp *checkpoint.Checkpoint) *snapshot {
+	s := &snapshot{seq: cp.Seq, keys: make(map[int64]bool), gc: this.gc}
+	for _, e := range cp.Extents {
+		s.keys[e.Key] = true
+	}
+
+	return s
+}
+
+func (this *snapshot) pin() {
+	for k := range this.keys {
+		this.gc.Pin(k)
+	}
+}
+
+func (this *snapshot) unpin() {
+	for k := range this.keys {
+		this.gc.Unpin(k)
+	}
+}
+
+// loadSnapshots pins objects of all snapshots stored in the object store. It
+// has to be called before the GC starts.
+func (this *ObjectBackend) loadSnapshots() {
+	this.snapshotMutex.Lock()
+	defer this.snapshotMutex.Unlock()
+
+	names, err := this.store.ListMeta(snapshotPrefix)
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range names {
+		buf, err := this.store.GetMeta(name)
+		if err != nil {
+			panic(err)
+		}
+		cp, err := checkpoint.Decode(buf)
+		if err != nil {
+			panic(fmt.Sprintf("Snapshot %v is unreadable: %v", name, err))
+		}
+
+		s := this.newSnapshot(cp)
+		s.pin()
+		this.snapshots[strings.TrimPrefix(name, snapshotPrefix)] = s
+	}
+}
+
+// createSnapshot stores the current extent map under the name. The snapshot
+// is crash-consistent, it contains all writes acknowledged to the object
+// backend before it was taken.
+func (this *ObjectBackend) createSnapshot(name string) error {
+	if !snapshotName.MatchString(name) {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+
+	this.snapshotMutex.Lock()
+	defer this.snapshotMutex.Unlock()
+
+	if this.snapshots[name] != nil {
+		return fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	// Writes still in the open object would be missing otherwise
+	if !this.flush() {
+		return errors.New("volume is closing")
+	}
+	this.gc.Collecting.Lock()
+	this.gc.Running.Lock()
+	cp := checkpoint.Checkpoint{
+		Volume:  this.volume,
+		Seq:     atomic.LoadInt64(&this.seqNumber),
+		Objects: this.gc.Sizes(),
+		Extents: this.em.Extents(),
+	}
+	s := this.newSnapshot(&cp)
+	s.pin()
+	this.gc.Running.Unlock()
+	this.gc.Collecting.Unlock()
+
+	this.waitForUploads(cp.Seq)
+
+	buf := checkpoint.Encode(&cp)
+	if err := this.store.PutMeta(snapshotPrefix+name, buf); err != nil {
+		s.unpin()
+		return err
+	}
+	this.snapshots[name] = s
+	fmt.Println("Snapshot", name, "created at", cp.Seq)
+	this.replicateAfter("Snapshot "+name, func(st api.ObjectStore) error {
+		return st.PutMeta(snapshotPrefix+name, buf)
+	})
+
+	return nil
+}
+
+func (this *ObjectBackend) deleteSnapshot(name string) error {
+	this.snapshotMutex.Lock()
+	defer this.snapshotMutex.Unlock()
+
+	s := this.snapshots[name]
+	if s == nil {
+		return fmt.Errorf("snapshot %q does not exist", name)
+	}
+
+	if err := this.store.DeleteMeta(snapshotPrefix + name); err != nil {
+		return err
+	}
+	delete(this.snapshots, name)
+	s.unpin()
+	this.replicateAfter("Deletion of snapshot "+name, func(st api.ObjectStore) error {
+		return st.DeleteMeta(snapshotPrefix + name)
+	})
+	fmt.Println("Snapshot", name, "deleted")
+
+	return nil
+}
+
+func (this *ObjectBackend) listSnapshots() []string {
+	this.snapshotMutex.Lock()
+	defer this.snapshotMutex.Unlock()
+
+	list := make([]string, 0, len(this.snapshots))
+	for name, s := range this.snapshots {
+		list = append(list, fmt.Sprintf("%v %v %v", name, s.seq, len(s.keys)))
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+func (this *ObjectBackend) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, "name seq objects")
+		for _, s := range this.listSnapshots() {
+			fmt.Fprintln(w, s)
+		}
+		return
+	case http.MethodPost:
+		err = this.createSnapshot(r.URL.Query().Get("name"))
+	case http.MethodDelete:
+		err = this.deleteSnapshot(r.URL.Query().Get("name"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
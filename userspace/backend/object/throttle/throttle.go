@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package throttle
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// Weight of a new sample in the average latency
+	latencyWeight = 0.2
+	// Latency is not known if there was no foreground request for so long
+	latencyStale = time.Second
+	pausePoll    = 100 * time.Millisecond
+)
+
+// Throttle limits the bandwidth and the request rate of the background work
+// and pauses it while the latency of the foreground requests is high. Limits
+// which are zero are disabled.
+type Throttle struct {
+	bytes    *bucket
+	requests *bucket
+
+	threshold time.Duration
+	mutex     sync.Mutex
+	latency   float64
+	sampled   time.Time
+}
+
+func New(bandwidth, requests float64, threshold time.Duration) *Throttle {
+	return &Throttle{
+		bytes:     newBucket(bandwidth),
+		requests:  newBucket(requests),
+		threshold: threshold,
+	}
+}
+
+// Wait blocks until a request transferring n bytes fits into the limits.
+func (this *Throttle) Wait(n int64) {
+	this.requests.take(1)
+	this.bytes.take(float64(n))
+}
+
+// Observe records the latency of a foreground request.
+func (this *Throttle) Observe(d time.Duration) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if time.Since(this.sampled) > latencyStale {
+		this.latency = float64(d)
+	} else {
+		this.latency += latencyWeight * (float64(d) - this.latency)
+	}
+	this.sampled = time.Now()
+}
+
+// Latency returns the average latency of recent foreground requests.
+func (this *Throttle) Latency() time.Duration {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if time.Since(this.sampled) > latencyStale {
+		return 0
+	}
+	return time.Duration(this.latency)
+}
+
+// Pause blocks while the foreground latency is above the threshold and
+// returns true if it did. It must not be called while holding locks the
+// foreground requests need.
+func (this *Throttle) Pause() bool {
+	if this.threshold == 0 {
+		return false
+	}
+
+	var paused bool
+	for this.Latency() > this.threshold {
+		paused = true
+		time.Sleep(pausePoll)
+	}
+
+	return paused
+}
+
+// bucket is a token bucket holding at most a second worth of tokens. Takes
+// larger than the bucket are allowed, the following ones wait for them.
+type bucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &bucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (this *bucket) take(n float64) {
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	now := time.Now()
+	this.tokens = math.Min(this.rate, this.tokens+now.Sub(this.last).Seconds()*this.rate)
+	this.last = now
+	this.tokens -= n
+	wait := time.Duration(-this.tokens / this.rate * float64(time.Second))
+	this.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
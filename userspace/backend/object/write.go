@@ -5,10 +5,9 @@ package object
 
 import (
 	"dis/backend/object/extmap"
-	"dis/backend/object/gc"
-	"dis/cache"
+	"dis/backend/object/header"
 	"dis/extent"
-	"encoding/binary"
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,12 +18,7 @@ const (
 	uploadWorkers    = 30
 	cacheReadWorkers = 30
 	maxWritePeriod   = 5 * time.Second
-)
-
-var (
-	mutex        sync.RWMutex
-	uploading    = make(map[int64]bool)
-	writelistLen int64
+	maxRetryDelay    = 10 * time.Second
 )
 
 type cacheReadJob struct {
@@ -35,30 +29,46 @@ type cacheReadJob struct {
 }
 
 type Object struct {
+	b         *ObjectBackend
 	buf       *[]byte
 	writelist *[]*extmap.Extent
 	blocks    int64
 	reads     *sync.WaitGroup
 	key       int64
 	extents   int64
+	frames    []header.Frame
+	fresh     []pendingBlock
+	pins      []int64
+	selfRefs  []selfRef
 }
 
-func nextObject(inGC bool) *Object {
-	buf := make([]byte, 0, objectSize)
+// selfRef is a reference entry pointing into the object itself.
+type selfRef struct {
+	entry int64
+	pba   int64
+}
+
+// Extents of the object are marked by the unassigned key until the object
+// gets its key, other extents in the writelist are references.
+const unassigned = -2
+
+func (this *ObjectBackend) nextObject(inGC bool) *Object {
+	buf := make([]byte, 0, this.objectSize)
 	var writelist []*extmap.Extent
 	if inGC {
 		writelist = make([]*extmap.Extent, 0, 0)
 	} else {
-		writelist = make([]*extmap.Extent, 0, writelistLen)
+		writelist = make([]*extmap.Extent, 0, this.writelistLen)
 	}
 	var reads sync.WaitGroup
-	var headerBlocks int64 = (writelistLen * 16) / 512
 
 	o := Object{
+		b:         this,
 		buf:       &buf,
 		writelist: &writelist,
 		reads:     &reads,
-		blocks:    headerBlocks,
+		blocks:    this.headerBlocks,
+		key:       unassigned,
 	}
 
 	return &o
@@ -69,13 +79,17 @@ func (this *Object) size() int64 {
 }
 
 func (this *Object) assignKey() {
-	this.key = atomic.LoadInt64(&seqNumber)
-	atomic.AddInt64(&seqNumber, 1)
-	var headerBlocks int64 = (writelistLen * 16) / 512
-	gc.Create(this.key, this.blocks-headerBlocks)
+	this.key = atomic.LoadInt64(&this.b.seqNumber)
+	atomic.AddInt64(&this.b.seqNumber, 1)
+	this.b.gc.Create(this.key, this.blocks-this.b.headerBlocks)
 
 	for _, e := range *this.writelist {
-		e.Key = this.key
+		if e.Key == unassigned {
+			e.Key = this.key
+		}
+	}
+	for _, r := range this.selfRefs {
+		header.PutEntry(*this.buf, this.b.objectSize, r.entry+1, this.key, r.pba)
 	}
 }
 
@@ -91,31 +105,73 @@ func (o *Object) add(lba, length int64, inGC bool) []byte {
 			Key: o.key})
 	}
 
-	o.fillHeader(lba, length)
+	header.PutEntry(*o.buf, o.b.objectSize, o.extents, lba, length)
 	o.extents++
 	o.blocks += length
 
 	return slice
 }
 
-func (o *Object) fillHeader(lba, length int64) {
-	const int64Size = 8
-	off := o.extents * int64Size * 2
+// seal writes the fixed part of the header together with the checksums of the
+// data. If the compression or the encryption is enabled, the buffer is
+// replaced by the packed object. It has to be called after the key is assigned and all
+// the data are read into the buffer.
+func (o *Object) seal() {
+	h := header.Header{
+		Volume:     o.b.volume,
+		Seq:        o.key,
+		Extents:    o.extents,
+		ObjectSize: o.b.objectSize,
+		Size:       o.b.headerBlocks * 512,
+		DataSize:   (o.blocks - o.b.headerBlocks) * 512,
+	}
 
-	headerSlice := (*o.buf)[off:]
-	binary.PutVarint(headerSlice, lba)
+	var frames []header.Frame
+	if buf, ok := o.pack(&h); ok {
+		frames = o.frames
+		*o.buf = buf
+		o.b.gc.SetPhysical(o.key, (h.DataSize+511)/512)
+	} else {
+		header.Seal(*o.buf, &h)
+	}
 
-	headerSlice = headerSlice[int64Size:]
-	binary.PutVarint(headerSlice, length)
+	sums, err := h.Sums((*o.buf)[h.SumOffset:])
+	if err != nil {
+		panic(err)
+	}
+	o.b.infoCache.Add(o.key, &objectInfo{h.Size, h.DataSize, h.BlockSize, sums, frames, h.Cipher, h.Nonce, h.AAD()})
 }
 
-func writer() {
-	writelistLen = objectSize / 512
+// retry calls fn until it succeeds, logging the failures. It is used where
+// giving up would lose writes already acknowledged by the kernel.
+func retry(what string, fn func() error) {
+	delay := 10 * time.Millisecond
+	for {
+		err := fn()
+		if err == nil {
+			return
+		}
+		fmt.Printf("%v failed, retrying in %v: %v\n", what, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// writer packs written extents into objects. Once the backend is closed, the
+// last object is uploaded and it returns after all uploads are done.
+func (this *ObjectBackend) writer() {
+	defer this.workers.Done()
+
+	this.writelistLen = this.objectSize / 512
 	cacheReadChan := make(chan cacheReadJob)
 	for i := 0; i < cacheReadWorkers; i++ {
 		go func() {
 			for c := range cacheReadChan {
-				cache.Read(c.buf, c.e.PBA*512)
+				retry("Cache read", func() error {
+					return this.cache.Read(c.buf, c.e.PBA*512)
+				})
 				c.reads.Done()
 				c.allReads.Done()
 			}
@@ -123,53 +179,91 @@ func writer() {
 	}
 
 	uploadChan := make(chan *Object)
+	var uploads sync.WaitGroup
+	uploads.Add(uploadWorkers)
 	for i := 0; i < uploadWorkers; i++ {
 		go func() {
+			defer uploads.Done()
 			for u := range uploadChan {
 				*u.buf = (*u.buf)[:cap(*u.buf)]
 				u.reads.Wait()
-				uploadF(u.key, u.buf)
-				mutex.Lock()
-				delete(uploading, u.key)
-				mutex.Unlock()
+				u.seal()
+				retry(fmt.Sprint("Upload of object ", u.key), func() error {
+					return this.store.Put(u.key, *u.buf)
+				})
+				this.mutex.Lock()
+				delete(this.uploading, u.key)
+				this.mutex.Unlock()
 			}
 		}()
 	}
 
 	ticker := time.NewTicker(maxWritePeriod)
 
-	o := nextObject(false)
+	o := this.nextObject(false)
 	upload := func() {
 		if o.extents == 0 {
 			return
 		}
-		gc.Running.Lock()
+		this.gc.Running.Lock()
 		o.assignKey()
-		mutex.Lock()
-		uploading[o.key] = true
-		mutex.Unlock()
-		em.Update(o.writelist)
+		this.mutex.Lock()
+		this.uploading[o.key] = true
+		this.mutex.Unlock()
+		this.em.Update(o.writelist)
+		o.publish()
 
-		gc.Running.Unlock()
+		this.gc.Running.Unlock()
 
 		uploadChan <- o
-		o = nextObject(false)
+		o = this.nextObject(false)
 		for len(ticker.C) > 0 {
 			<-ticker.C
 		}
 		ticker.Reset(maxWritePeriod)
 	}
 
+	// writeDedup stores only blocks of the extent which are not stored yet
+	writeDedup := func(e *extent.Extent) {
+		buf := make([]byte, e.Len*512)
+		retry("Cache read", func() error {
+			return this.cache.Read(&buf, e.PBA*512)
+		})
+
+		for _, s := range this.planDedup(e.LBA, buf) {
+			if !o.fits(&s) || len(ticker.C) > 0 {
+				upload()
+			}
+
+			if s.ref != nil {
+				o.addRef(s.lba, s.len, s.ref)
+				continue
+			}
+
+			pba := o.blocks
+			slice := o.add(s.lba, s.len, false)
+			copy(slice, buf[(s.lba-e.LBA)*512:])
+			for _, b := range s.blocks {
+				o.fresh = append(o.fresh, pendingBlock{b.fp, pba + b.pba})
+			}
+		}
+	}
+
 	var allReads sync.WaitGroup
 	for {
 		select {
-		case extents := <-workloads:
+		case extents := <-this.workloads:
 			for i := range *extents {
 				e := &(*extents)[i]
 
 				//fmt.Println("Writing:", *e)
 
-				if o.size()+e.Len*512 > objectSize || len(ticker.C) > 0 {
+				if this.dedup {
+					writeDedup(e)
+					continue
+				}
+
+				if o.size()+e.Len*512 > this.objectSize || len(ticker.C) > 0 {
 					upload()
 				}
 
@@ -181,6 +275,16 @@ func writer() {
 			allReads.Wait()
 		case <-ticker.C:
 			upload()
+		case flushed := <-this.flushes:
+			upload()
+			close(flushed)
+		case <-this.done:
+			upload()
+			ticker.Stop()
+			close(cacheReadChan)
+			close(uploadChan)
+			uploads.Wait()
+			return
 		}
 	}
 }
@@ -234,6 +338,22 @@ func writer() {
 //	}
 //}
 
-func (this *ObjectBackend) Write(extents *[]extent.Extent) {
-	workloads <- extents
+func (this *ObjectBackend) Write(extents *[]extent.Extent) error {
+	this.workloads <- extents
+	return nil
+}
+
+// flush makes the writer upload the object it is filling, so all writes
+// acknowledged before are assigned keys. It returns false if the backend was
+// closed meanwhile.
+func (this *ObjectBackend) flush() bool {
+	flushed := make(chan struct{})
+	select {
+	case this.flushes <- flushed:
+	case <-this.done:
+		return false
+	}
+	<-flushed
+
+	return true
 }
@@ -6,6 +6,7 @@ package cache
 import (
 	"dis/extent"
 	"dis/parser"
+	"errors"
 	"math"
 
 	"golang.org/x/sys/unix"
@@ -16,57 +17,69 @@ const (
 	envPrefix     = "dis_cache"
 )
 
-var (
-	Base          int64
-	Bound         int64
-	Frontier      int64
-	file          string
-	fd            int
-	headerSectors int64 = 8
-)
+var headerSectors int64 = 8
+
+// Cache is the region of the caching device used by a single volume.
+type Cache struct {
+	Base     int64
+	Bound    int64
+	Frontier int64
+	file     string
+	fd       int
+}
 
-func Init() {
-	v := parser.Sub(configSection)
+func New(cfg *parser.Config) (*Cache, error) {
+	v := cfg.Sub(configSection)
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("base")
 	v.BindEnv("bound")
 	v.BindEnv("file")
-	Base = v.GetInt64("base")
-	Bound = v.GetInt64("bound")
-	file = v.GetString("file")
+	this := &Cache{
+		Base:  v.GetInt64("base"),
+		Bound: v.GetInt64("bound"),
+		file:  v.GetString("file"),
+	}
 
-	if Base == 0 || Bound == 0 || file == "" {
-		panic("")
+	if this.Base == 0 || this.Bound == 0 || this.file == "" {
+		return nil, errors.New("cache base, bound and file have to be set")
 	}
-	Frontier = Base
+	this.Frontier = this.Base
 
 	var err error
-	fd, err = unix.Open(file, unix.O_RDWR|unix.O_DIRECT, 0)
+	this.fd, err = unix.Open(this.file, unix.O_RDWR|unix.O_DIRECT, 0)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
+	return this, nil
 }
 
-func Write(buf *[]byte, dest int64) {
-	_, err := unix.Pwrite(fd, *buf, dest)
-	if err != nil {
-		panic(err)
-	}
+// Overlaps returns true if both regions are on the same device and share any
+// sector.
+func (this *Cache) Overlaps(other *Cache) bool {
+	return this.file == other.file && this.Base < other.Bound && other.Base < this.Bound
 }
 
-func Read(buf *[]byte, dest int64) {
-	_, err := unix.Pread(fd, *buf, dest)
-	if err != nil {
-		panic(err)
-	}
+func (this *Cache) Close() error {
+	return unix.Close(this.fd)
+}
+
+func (this *Cache) Write(buf *[]byte, dest int64) error {
+	_, err := unix.Pwrite(this.fd, *buf, dest)
+	return err
+}
+
+func (this *Cache) Read(buf *[]byte, dest int64) error {
+	_, err := unix.Pread(this.fd, *buf, dest)
+	return err
 }
 
-func Reserve(e *extent.Extent) {
-	if Frontier+e.Len >= Bound {
-		Frontier = Base
+func (this *Cache) Reserve(e *extent.Extent) {
+	if this.Frontier+e.Len >= this.Bound {
+		this.Frontier = this.Base
 	}
-	e.PBA = Frontier
-	Frontier += roundUp(e.Len, 8)
+	e.PBA = this.Frontier
+	this.Frontier += roundUp(e.Len, 8)
 }
 
 func roundDown(x, y int64) int64 { return x - x%y }
@@ -78,7 +91,7 @@ type Prereader struct {
 	off2 int64
 }
 
-func NewPrereader(extents *[]extent.Extent) *Prereader {
+func (this *Cache) NewPrereader(extents *[]extent.Extent) (*Prereader, error) {
 	prereader := new(Prereader)
 	var begin, end bool
 	for i := range *extents {
@@ -86,7 +99,7 @@ func NewPrereader(extents *[]extent.Extent) *Prereader {
 		if e.PBA == 0+headerSectors {
 			begin = true
 		}
-		if e.PBA > 2*Base/3 {
+		if e.PBA > 2*this.Base/3 {
 			end = true
 		}
 	}
@@ -95,7 +108,7 @@ func NewPrereader(extents *[]extent.Extent) *Prereader {
 	if wrapped {
 		minL := int64(0)
 		maxL := minL
-		minR := Base
+		minR := this.Base
 		maxR := int64(math.MinInt64)
 		for i := range *extents {
 			e := &(*extents)[i]
@@ -117,8 +130,12 @@ func NewPrereader(extents *[]extent.Extent) *Prereader {
 		prereader.off2 = minR
 		bufL := prereader.buf[:(maxL-minL)*512]
 		bufR := prereader.buf[(maxR-minR)*512:]
-		Read(&bufL, minL*512)
-		Read(&bufR, minR*512)
+		if err := this.Read(&bufL, minL*512); err != nil {
+			return nil, err
+		}
+		if err := this.Read(&bufR, minR*512); err != nil {
+			return nil, err
+		}
 	} else {
 		var min, max int64 = math.MaxInt64, math.MinInt64
 		for i := range *extents {
@@ -133,10 +150,12 @@ func NewPrereader(extents *[]extent.Extent) *Prereader {
 		prereader.buf = make([]byte, (max-min)*512)
 		prereader.off1 = min
 		prereader.off2 = 0
-		Read(&prereader.buf, min*512)
+		if err := this.Read(&prereader.buf, min*512); err != nil {
+			return nil, err
+		}
 	}
 
-	return prereader
+	return prereader, nil
 }
 
 func (this *Prereader) Copy(buf []byte, dest int64) {
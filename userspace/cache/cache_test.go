@@ -0,0 +1,50 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package cache
+
+import (
+	"dis/extent"
+	"dis/parser"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrereaderError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dis-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "cache.img")
+	if err := ioutil.WriteFile(file, make([]byte, 1024*512), 0600); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "config.toml")
+	conf := fmt.Sprintf("[cache]\nbase = 64\nbound = 1024\nfile = %q\n", file)
+	if err := ioutil.WriteFile(name, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parser.Load(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Skip("cache file not usable:", err)
+	}
+
+	extents := []extent.Extent{{LBA: 0, PBA: 64, Len: 8}}
+	if _, err := c.NewPrereader(&extents); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if _, err := c.NewPrereader(&extents); err == nil {
+		t.Fatal("read of a closed cache succeeded")
+	}
+}
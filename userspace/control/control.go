@@ -0,0 +1,192 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package control
+
+import (
+	"context"
+	"dis/parser"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	configSection = "control"
+	envPrefix     = "dis_control"
+)
+
+var (
+	socket string
+
+	// Handlers by the volume and the path, daemon-wide ones are registered
+	// for the empty volume.
+	mutex    sync.RWMutex
+	handlers = make(map[string]map[string]http.HandlerFunc)
+)
+
+// Init starts serving the control interface on the unix socket, if it is
+// configured.
+func Init() {
+	readConfig()
+	if socket == "" {
+		return
+	}
+
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		panic(http.Serve(l, http.HandlerFunc(serve)))
+	}()
+}
+
+func readConfig() {
+	v := parser.Sub(configSection)
+	v.SetEnvPrefix(envPrefix)
+	v.BindEnv("socket")
+	socket = v.GetString("socket")
+}
+
+// Handle registers handler for requests to the path of the volume. Handlers
+// of the empty volume serve the whole daemon.
+func Handle(volume, path string, handler func(w http.ResponseWriter, r *http.Request)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if handlers[volume] == nil {
+		handlers[volume] = make(map[string]http.HandlerFunc)
+	}
+	handlers[volume][path] = handler
+}
+
+// Unhandle removes the handler registered for the path of the volume.
+func Unhandle(volume, path string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(handlers[volume], path)
+	if len(handlers[volume]) == 0 {
+		delete(handlers, volume)
+	}
+}
+
+// serve passes the request to the handler of the volume given in the query.
+// The volume may be omitted if only one volume handles the path.
+func serve(w http.ResponseWriter, r *http.Request) {
+	volume := r.URL.Query().Get("volume")
+
+	mutex.RLock()
+	handler := handlers[""][r.URL.Path]
+	if handler == nil && volume != "" {
+		handler = handlers[volume][r.URL.Path]
+	} else if handler == nil {
+		var n int
+		for _, h := range handlers {
+			if h[r.URL.Path] != nil {
+				handler = h[r.URL.Path]
+				n++
+			}
+		}
+		if n > 1 {
+			mutex.RUnlock()
+			http.Error(w, "several volumes are served, the volume has to be given", http.StatusBadRequest)
+			return
+		}
+	}
+	mutex.RUnlock()
+
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler(w, r)
+}
+
+type command struct {
+	method string
+	path   string
+	args   []string
+}
+
+var commands = map[string]map[string]command{
+	"replication": {
+		"status": {http.MethodGet, "/replication", nil},
+	},
+	"snapshot": {
+		"create": {http.MethodPost, "/snapshots", []string{"name"}},
+		"list":   {http.MethodGet, "/snapshots", nil},
+		"delete": {http.MethodDelete, "/snapshots", []string{"name"}},
+	},
+	"volume": {
+		"add":    {http.MethodPost, "/volumes", []string{"name", "config"}},
+		"list":   {http.MethodGet, "/volumes", nil},
+		"remove": {http.MethodDelete, "/volumes", []string{"name"}},
+	},
+}
+
+// Command sends the command given on the command line to the running daemon
+// and prints its response.
+func Command(args []string) error {
+	readConfig()
+	if socket == "" {
+		return fmt.Errorf("control socket is not configured")
+	}
+
+	if len(args) < 2 || commands[args[0]] == nil {
+		return fmt.Errorf("usage: dis <command> <subcommand> [args]")
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok || len(args)-2 != len(cmd.args) {
+		return fmt.Errorf("unknown command: %v", args)
+	}
+
+	query := url.Values{}
+	for i, name := range cmd.args {
+		arg := args[2+i]
+		if name == "config" {
+			// The daemon may run in another directory
+			var err error
+			if arg, err = filepath.Abs(arg); err != nil {
+				return err
+			}
+		}
+		query.Set(name, arg)
+	}
+	if volume := parser.Volume(); volume != "" {
+		query.Set("volume", volume)
+	}
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	req, err := http.NewRequest(cmd.method, "http://dis"+cmd.path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %s", resp.Status, msg)
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -4,22 +4,44 @@
 package main
 
 import (
-	"dis/backend"
-	"dis/cache"
-	"dis/ioctl"
+	_ "dis/backend/file"
+	_ "dis/backend/null"
+	"dis/backend/object"
+	"dis/control"
 	//"dis/l2cache"
 	"dis/parser"
+	"dis/volume"
+	"fmt"
 	"os"
+	"sort"
 )
 
+// Volume served from the main configuration if it lists no volumes
+const defaultVolume = "default"
+
 func main() {
+	parser.Init()
+
+	if args := parser.Args(); len(args) > 0 {
+		var err error
+		if args[0] == "migrate" {
+			err = migrate(args[1:])
+		} else {
+			err = control.Command(args)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	print("Initializing... ")
 
-	parser.Init()
-	cache.Init()
 	//l2cache.Init()
-	ioctl.Init()
-	backend.Init()
+	control.Init()
+	volume.Init()
+	addVolumes()
 
 	println("Done")
 
@@ -30,7 +52,48 @@ func main() {
 	f.Close()
 
 	done := make(chan struct{})
-	go ioctl.Read()
-	go ioctl.Write()
 	<-done
 }
+
+// addVolumes serves the volumes listed in the main configuration, or the main
+// configuration itself as a single volume.
+func addVolumes() {
+	if !parser.Main().IsSet("volumes") {
+		if err := volume.Add(defaultVolume, parser.Main()); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	v := parser.Sub("volumes")
+	names := v.AllKeys()
+	sort.Strings(names)
+	for _, name := range names {
+		cfg, err := parser.Load(parser.Main().Path(v.GetString(name)))
+		if err != nil {
+			panic(err)
+		}
+		if err := volume.Add(name, cfg); err != nil {
+			panic(fmt.Sprintf("Volume %v: %v", name, err))
+		}
+	}
+}
+
+// migrate copies a volume between object stores. It runs offline, the daemon
+// must not serve the volume meanwhile.
+func migrate(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: dis migrate <source config> <target config>")
+	}
+
+	from, err := parser.Load(args[0])
+	if err != nil {
+		return err
+	}
+	to, err := parser.Load(args[1])
+	if err != nil {
+		return err
+	}
+
+	return object.Migrate(from, to)
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package extent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Errors is returned by backends when only some extents of a batch failed.
+// Any other error means that the whole batch failed.
+type Errors map[*Extent]error
+
+func (this Errors) Error() string {
+	for e, err := range this {
+		if len(this) == 1 {
+			return fmt.Sprintf("extent %v: %v", *e, err)
+		}
+		return fmt.Sprintf("%v extents failed, e.g. %v: %v", len(this), *e, err)
+	}
+
+	return "no extent failed"
+}
+
+// Failed returns true if the extent failed according to the error returned
+// for its batch.
+func Failed(err error, e *Extent) bool {
+	if err == nil {
+		return false
+	}
+	if errs, ok := err.(Errors); ok {
+		return errs[e] != nil
+	}
+
+	return true
+}
+
+// Collector gathers errors of extents processed concurrently.
+type Collector struct {
+	mutex  sync.Mutex
+	failed Errors
+}
+
+func (this *Collector) Add(e *Extent, err error) {
+	if err == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.failed == nil {
+		this.failed = make(Errors)
+	}
+	this.failed[e] = err
+}
+
+// Err returns Errors of the failed extents or nil if none failed.
+func (this *Collector) Err() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.failed == nil {
+		return nil
+	}
+
+	return this.failed
+}
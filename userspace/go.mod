@@ -7,7 +7,10 @@ require (
 	github.com/ceph/go-ceph v0.4.0
 	github.com/emirpasic/gods v1.12.0
 	github.com/hashicorp/golang-lru v0.5.1
+	github.com/klauspost/compress v1.11.0
+	github.com/pierrec/lz4/v4 v4.1.0
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.7.1
+	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 	golang.org/x/sys v0.0.0-20201015000850-e3ed0017c211
 )
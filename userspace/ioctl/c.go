@@ -18,3 +18,7 @@ func writeNo() uint {
 func resolveNo() uint {
 	return C.IOCTL_DIS_RESOLVE
 }
+
+func pbaNone() int64 {
+	return C.PBA_NONE
+}
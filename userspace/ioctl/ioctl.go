@@ -4,10 +4,15 @@
 package ioctl
 
 import (
+	"dis/backend"
+	"dis/cache"
 	"dis/extent"
 	"dis/parser"
+	"errors"
 	"golang.org/x/sys/unix"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -16,29 +21,55 @@ const (
 	envPrefix     = "dis_ioctl"
 )
 
-var (
-	n     int
-	ctl   string
-	ctlFD int
-)
+// Device is the control device of a single volume. Requests of the kernel
+// are served from its cache and backend.
+type Device struct {
+	n       int
+	fd      int
+	cache   *cache.Cache
+	backend backend.Backend
+	stopped int32
+	loops   sync.WaitGroup
+}
 
-func Init() {
-	v := parser.Sub(configSection)
+func Open(cfg *parser.Config, c *cache.Cache, b backend.Backend) (*Device, error) {
+	v := cfg.Sub(configSection)
 	v.SetEnvPrefix(envPrefix)
 	v.BindEnv("ctl")
 	v.BindEnv("extents")
-	ctl = v.GetString("ctl")
-	n = v.GetInt("extents")
+	ctl := v.GetString("ctl")
+	n := v.GetInt("extents")
 
 	if n == 0 || ctl == "" {
-		panic("")
+		return nil, errors.New("ioctl ctl and extents have to be set")
 	}
 
-	var err error
-	ctlFD, err = unix.Open(ctl, unix.O_RDWR, 0)
+	fd, err := unix.Open(ctl, unix.O_RDWR, 0)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+
+	return &Device{n: n, fd: fd, cache: c, backend: b}, nil
+}
+
+// Start serves reads and writes of the kernel until the device is closed.
+func (this *Device) Start() {
+	this.loops.Add(2)
+	go this.Read()
+	go this.Write()
+}
+
+// Close stops serving the kernel. Requests received before are finished,
+// the kernel returns no more than a second after.
+func (this *Device) Close() error {
+	atomic.StoreInt32(&this.stopped, 1)
+	this.loops.Wait()
+
+	return unix.Close(this.fd)
+}
+
+func (this *Device) running() bool {
+	return atomic.LoadInt32(&this.stopped) == 0
 }
 
 type ioctlRW struct {
@@ -52,8 +83,8 @@ type ioctlResolve struct {
 	clearLO, clearHI int64
 }
 
-func RWIOCTL(ioctlNo uint) *[]extent.Extent {
-	extents := make([]extent.Extent, n)
+func (this *Device) RWIOCTL(ioctlNo uint) *[]extent.Extent {
+	extents := make([]extent.Extent, this.n)
 
 	ioctl := ioctlRW{
 		extentsN: len(extents),
@@ -61,7 +92,7 @@ func RWIOCTL(ioctlNo uint) *[]extent.Extent {
 	}
 
 	p := unsafe.Pointer(&ioctl)
-	err := unix.IoctlSetInt(ctlFD, ioctlNo, int(uintptr(p)))
+	err := unix.IoctlSetInt(this.fd, ioctlNo, int(uintptr(p)))
 	if err != nil {
 		panic(err)
 	}
@@ -88,7 +119,7 @@ func updateLen(extents *[]extent.Extent) {
 	}
 }
 
-func resolveIOCTL(extents *[]extent.Extent, clearLO, clearHI int64) {
+func (this *Device) resolveIOCTL(extents *[]extent.Extent, clearLO, clearHI int64) {
 	resolve := ioctlResolve{
 		extentsN: len(*extents),
 		extents:  rawData(*extents),
@@ -97,7 +128,7 @@ func resolveIOCTL(extents *[]extent.Extent, clearLO, clearHI int64) {
 	}
 
 	p := unsafe.Pointer(&resolve)
-	err := unix.IoctlSetInt(ctlFD, resolveNo(), int(uintptr(p)))
+	err := unix.IoctlSetInt(this.fd, resolveNo(), int(uintptr(p)))
 	if err != nil {
 		panic(err)
 	}
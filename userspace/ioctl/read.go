@@ -4,41 +4,49 @@
 package ioctl
 
 import (
-	"dis/backend"
-	"dis/cache"
+	"dis/extent"
 	"fmt"
 )
 
-func Read() {
+func (this *Device) Read() {
+	defer this.loops.Done()
 	var nextClean int64
 
-	for {
-		extents := RWIOCTL(readNo())
-		// FIXME: Probable bug in kernel code, sometimes zero-length ioctl set is being sent
+	for this.running() {
+		// The kernel returns no extents if there was no read for a while
+		extents := this.RWIOCTL(readNo())
 		if len(*extents) == 0 {
-			println("R IOCTL: Zero-length extent set received from kernel!")
 			continue
 		}
 		for i := range *extents {
 			e := &(*extents)[i]
-			cache.Reserve(e)
+			this.cache.Reserve(e)
+		}
+		if err := this.backend.Read(extents); err != nil {
+			fmt.Println("Read failed:", err)
+			for i := range *extents {
+				e := &(*extents)[i]
+				if extent.Failed(err, e) {
+					e.PBA = pbaNone()
+				}
+			}
 		}
-		backend.Read(extents)
 
 		// FIXME: If the length of read extents in this round makes the
 		// frontier to jump over two octants it fails to clean the
 		// skipped octant.
-		octant := 8 * (cache.Frontier - cache.Base) / (cache.Bound - cache.Base)
-		eight := (cache.Bound - cache.Base) / 8
+		c := this.cache
+		octant := 8 * (c.Frontier - c.Base) / (c.Bound - c.Base)
+		eight := (c.Bound - c.Base) / 8
 
 		var clearLO, clearHI int64
 		if (octant+2)%8 == nextClean {
-			clearLO = cache.Base + nextClean*eight
+			clearLO = c.Base + nextClean*eight
 			clearHI = clearLO + eight
 			nextClean = (nextClean + 1) % 8
 			fmt.Println("Cleaning from ", clearLO, "to ", clearHI)
 		}
 
-		resolveIOCTL(extents, clearLO, clearHI)
+		this.resolveIOCTL(extents, clearLO, clearHI)
 	}
 }
@@ -4,17 +4,34 @@
 package ioctl
 
 import (
-	"dis/backend"
+	"fmt"
+	"time"
 )
 
-func Write() {
-	for {
-		extents := RWIOCTL(writeNo())
-		// FIXME: Probable bug in kernel code, sometimes zero-length ioctl set is being sent
+const maxRetryDelay = 10 * time.Second
+
+func (this *Device) Write() {
+	defer this.loops.Done()
+
+	for this.running() {
+		// The kernel returns no extents if there was no write for a while
+		extents := this.RWIOCTL(writeNo())
 		if len(*extents) == 0 {
-			println("W IOCTL: Zero-length extent set received from kernel!")
 			continue
 		}
-		backend.Write(extents)
+		// The extents stay in the cache until the kernel receives the next
+		// batch, so a failed write is retried until it succeeds.
+		delay := 10 * time.Millisecond
+		for {
+			err := this.backend.Write(extents)
+			if err == nil {
+				break
+			}
+			fmt.Printf("Write failed, retrying in %v: %v\n", delay, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
 	}
 }
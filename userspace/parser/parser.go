@@ -6,6 +6,10 @@ package parser
 import (
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 const (
@@ -14,23 +18,104 @@ const (
 	configName = "config"
 )
 
-var v *viper.Viper
+var (
+	main   *Config
+	volume *string
+)
+
+// Config is a configuration file, either the main one or the one of a volume
+// added at runtime.
+type Config struct {
+	file string
+	v    *viper.Viper
+}
 
 func Init() {
 	config := flag.StringP("config", "c", configName+"."+configType, "Path to config file")
+	volume = flag.StringP("volume", "V", "", "Volume the command is sent to")
 	flag.Parse()
 
-	v = viper.New()
-	v.SetConfigFile(*config)
+	var err error
+	main, err = Load(*config)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Load reads the configuration file.
+func Load(file string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
 	v.SetConfigType(configType)
 	v.SetEnvPrefix(envPrefix)
 
-	err := v.ReadInConfig()
-	if err != nil {
-		panic(err)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
 	}
+
+	return &Config{file, v}, nil
+}
+
+// Main returns the configuration given on the command line.
+func Main() *Config {
+	return main
+}
+
+// Args returns the command line arguments left after parsing the flags.
+func Args() []string {
+	return flag.Args()
 }
 
+// Volume returns the volume given on the command line.
+func Volume() string {
+	return *volume
+}
+
+// Sub returns the section of the main configuration.
 func Sub(section string) *viper.Viper {
-	return v.Sub(section)
+	return main.Sub(section)
+}
+
+// Sub returns the configuration section. Missing sections are empty, so they
+// can be still configured through the environment.
+func (this *Config) Sub(section string) *viper.Viper {
+	if sub := this.v.Sub(section); sub != nil {
+		return sub
+	}
+	return viper.New()
+}
+
+// File returns the path of the configuration file.
+func (this *Config) File() string {
+	return this.file
+}
+
+// Path resolves the path relative to the directory of the configuration
+// file.
+func (this *Config) Path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(this.file), path)
+}
+
+// EnvOverrides returns the names of the environment variables overriding the
+// configuration. They are not scoped to a configuration file, so they apply to
+// every volume.
+func EnvOverrides() []string {
+	var names []string
+	prefix := strings.ToUpper(envPrefix) + "_"
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, prefix) {
+			names = append(names, strings.SplitN(env, "=", 2)[0])
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// IsSet returns true if the key is set in the configuration file.
+func (this *Config) IsSet(key string) bool {
+	return this.v.IsSet(key)
 }
@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: GPL-2.0-only
+// Copyright (C) 2020-2021 Vojtech Aschenbrenner <v@asch.cz>
+
+package volume
+
+import (
+	"dis/backend"
+	"dis/cache"
+	"dis/control"
+	"dis/ioctl"
+	"dis/parser"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var (
+	mutex   sync.Mutex
+	volumes = make(map[string]*volume)
+
+	// Names are used as keys of the configuration, which are lowercase
+	volumeName = regexp.MustCompile(`^[a-z0-9._-]+$`)
+)
+
+// volume is a block device served by the daemon. Each volume has its own
+// control device, cache region and backend.
+type volume struct {
+	name    string
+	cfg     *parser.Config
+	cache   *cache.Cache
+	backend backend.Backend
+	device  *ioctl.Device
+}
+
+// Init makes the volumes manageable through the control interface.
+func Init() {
+	control.Handle("", "/volumes", handler)
+}
+
+// Add starts serving the volume configured by cfg. The backend may panic
+// while it recovers the volume, the panic is returned as an error so the other
+// volumes keep running.
+func Add(name string, cfg *parser.Config) (err error) {
+	if !volumeName.MatchString(name) {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+
+	c, err := cache.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The name is reserved while the backend starts
+	mutex.Lock()
+	if _, ok := volumes[name]; ok {
+		mutex.Unlock()
+		c.Close()
+		return fmt.Errorf("volume %q already exists", name)
+	}
+	for _, v := range volumes {
+		if v != nil && v.cache.Overlaps(c) {
+			mutex.Unlock()
+			c.Close()
+			return fmt.Errorf("cache of volume %q overlaps volume %q", name, v.name)
+		}
+	}
+	// Overrides meant for one volume must not change the others
+	if env := parser.EnvOverrides(); len(volumes) > 0 && len(env) > 0 {
+		mutex.Unlock()
+		c.Close()
+		return fmt.Errorf("volume %q refused, environment overrides %v would apply to every volume", name, env)
+	}
+	volumes[name] = nil
+	mutex.Unlock()
+
+	v := &volume{name: name, cfg: cfg, cache: c}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			v.close()
+		}
+
+		mutex.Lock()
+		if err != nil {
+			delete(volumes, name)
+		} else {
+			volumes[name] = v
+		}
+		mutex.Unlock()
+	}()
+
+	v.backend, err = backend.New(&backend.Volume{Name: name, Config: cfg, Cache: c})
+	if err != nil {
+		return err
+	}
+	v.device, err = ioctl.Open(cfg, c, v.backend)
+	if err != nil {
+		return err
+	}
+	v.device.Start()
+	fmt.Println("Volume", name, "added")
+
+	return nil
+}
+
+// Remove stops serving the volume. Writes received from the kernel are
+// persisted by the backend before it returns.
+func Remove(name string) error {
+	mutex.Lock()
+	v, ok := volumes[name]
+	if !ok || v == nil {
+		mutex.Unlock()
+		return fmt.Errorf("volume %q does not exist", name)
+	}
+	volumes[name] = nil
+	mutex.Unlock()
+
+	err := v.close()
+
+	mutex.Lock()
+	delete(volumes, name)
+	mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	fmt.Println("Volume", name, "removed")
+
+	return nil
+}
+
+// close releases whatever parts of the volume were started.
+func (this *volume) close() error {
+	var err error
+	if this.device != nil {
+		err = this.device.Close()
+	}
+	if this.backend != nil {
+		if e := this.backend.Close(); err == nil {
+			err = e
+		}
+	}
+	if e := this.cache.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// List returns the names and configuration files of the served volumes.
+func List() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	list := make([]string, 0, len(volumes))
+	for name, v := range volumes {
+		if v == nil {
+			continue
+		}
+		list = append(list, fmt.Sprintf("%v %v", name, v.cfg.File()))
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, "name config")
+		for _, v := range List() {
+			fmt.Fprintln(w, v)
+		}
+		return
+	case http.MethodPost:
+		var cfg *parser.Config
+		cfg, err = parser.Load(r.URL.Query().Get("config"))
+		if err == nil {
+			err = Add(r.URL.Query().Get("name"), cfg)
+		}
+	case http.MethodDelete:
+		err = Remove(r.URL.Query().Get("name"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}